@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeffrom/tulpa/server"
+	"github.com/spf13/cobra"
+)
+
+func newReplayCmd() *cobra.Command {
+	cfg := &server.Config{}
+	var last int
+	replayCmd := &cobra.Command{
+		Use:   "replay <recording>",
+		Short: "Replay recorded requests against the app and report changed responses",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Initialize()
+			regressions, err := server.Replay(cfg, args[0], last)
+			if err != nil {
+				return err
+			}
+			if regressions > 0 {
+				return fmt.Errorf("%d regressions", regressions)
+			}
+			return nil
+		},
+	}
+
+	flags := replayCmd.Flags()
+	flags.IntVarP(&cfg.AppPort, "app-port", "a", 3000, "application port")
+	flags.StringVar(&cfg.Upstream, "upstream", "", "address to replay requests to (default http://localhost:<app-port>)")
+	flags.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "time to wait for the app to accept connections")
+	flags.IntVarP(&last, "last", "n", 0, "number of recorded requests to replay (default all)")
+
+	return replayCmd
+}
@@ -2,6 +2,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -17,28 +18,89 @@ var version = "none"
 
 func newRootCmd() *cobra.Command {
 	cfg := &server.Config{}
+	var configFile string
+	var faults []string
+	var summary bool
 	rootCmd := &cobra.Command{
 		Use:   "tulpa",
 		Short: "Development proxy with reload-after-change semantics",
 		Long:  `tulpa is a command line utility for live reloading applications.`,
-		Args:  cobra.MinimumNArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if configFile == "" {
+				return cobra.MinimumNArgs(1)(cmd, args)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return start(cfg, args)
+			for _, s := range faults {
+				f, err := server.ParseFault(s)
+				if err != nil {
+					return err
+				}
+				cfg.Faults = append(cfg.Faults, f)
+			}
+			if configFile != "" {
+				if err := cfg.Load(configFile); err != nil {
+					return err
+				}
+				if len(args) == 0 && len(cfg.Routes) == 0 {
+					return errors.New("a command or routes in the config file are required")
+				}
+			}
+			return start(cfg, args, summary)
 		},
 		Version: version,
 	}
 	rootCmd.SetVersionTemplate("{{.Version}}\n")
+	rootCmd.AddCommand(newReplayCmd())
 
 	flags := rootCmd.Flags()
-	flags.IntVarP(&cfg.AppPort, "app-port", "a", 3000, "application port")
+	flags.StringVarP(&configFile, "config", "c", "", "JSON config file containing routes")
+	flags.IntVarP(&cfg.AppPort, "app-port", "a", 3000, "application port, or 0 to pick a free one")
 	flags.IntVarP(&cfg.ProxyPort, "proxy-port", "p", 4000, "proxy port")
+	flags.StringVar(&cfg.Upstream, "upstream", "", "address to proxy requests to, such as unix:///path/to/sock (default http://localhost:<app-port>)")
+	flags.StringVar(&cfg.ProxySocket, "proxy-socket", "", "unix socket path to listen on instead of proxy-port")
+	flags.StringVar(&cfg.SocketEnv, "socket-env", "SOCKET", "environment variable the upstream unix socket path is passed in")
+	flags.StringVar(&cfg.PortEnv, "port-env", "PORT", "environment variable the upstream port is passed in")
 	flags.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "request timeout")
+	flags.IntVar(&cfg.MaxQueue, "max-queue", 100, "number of requests that can wait for the app at once, or 0 for no limit")
 	flags.DurationVar(&cfg.Debounce, "debounce", 200*time.Millisecond, "file watch debounce interval")
 	flags.DurationVar(&cfg.DebouncePoll, "debounce-poll", 1*time.Second, "poll interval while debounce is saturated")
 	flags.DurationVar(&cfg.Latency, "latency", 0, "Duration to wait to respond to requests")
 	flags.DurationVar(&cfg.LatencyJitter, "latency-jitter", 2*time.Second, "introduce randomness to latency duration")
-	// TODO ignore pattern is better
-	flags.StringArrayVarP(&cfg.IgnoreDirs, "ignore", "x", []string{"node_modules", "log", "tmp", "vendor", ".make"}, "directories to ignore")
+	flags.StringVar(&cfg.Network, "network", "", "simulate a slow network: slow-3g, 3g, 4g, dsl, or down:up[:latency] in kbps")
+	flags.StringArrayVar(&faults, "fault", nil, "inject faults into a percentage of requests, as kind:percent[:path]. kinds: error, reset, truncate, trickle, timeout")
+	flags.BoolVar(&cfg.CORS, "cors", false, "allow cross-origin requests from any origin, and answer preflight requests")
+	flags.StringVar(&cfg.AuthUser, "auth-user", "", "user to send to the app as if authenticated by a gateway")
+	flags.StringVar(&cfg.AuthHeader, "auth-header", "X-Forwarded-User", "header --auth-user is sent in. Clients can't set it themselves")
+	flags.BoolVar(&cfg.Compress, "compress", false, "compress text responses with brotli or gzip")
+	flags.BoolVar(&cfg.Cache, "cache", false, "cache responses in memory according to Cache-Control, and answer conditional requests")
+	flags.StringVar(&cfg.Static, "static", "", "directory of files to serve before proxying to the app, such as public or dist")
+	flags.BoolVar(&cfg.SPA, "spa", false, "serve the static directory's index.html for page loads that aren't files")
+	flags.BoolVar(&cfg.LiveReload, "live-reload", false, "reload pages served from the static directory when it changes")
+	flags.StringVar(&cfg.Trace, "trace", "", "send OpenTelemetry spans to an OTLP/HTTP collector, such as http://localhost:4318")
+	flags.BoolVar(&summary, "summary", false, "print request, scan and restart totals on shutdown")
+	flags.StringVar(&cfg.AccessLog, "access-log", "", "log requests in common, combined or json format")
+	flags.IntVar(&cfg.Inspect, "inspect", 0, "number of requests to keep for the inspector at /__tulpa/inspect")
+	flags.StringVar(&cfg.Record, "record", "", "file to record requests and responses to")
+	flags.IntVar(&cfg.Replay, "replay", 0, "number of recorded requests to replay after each restart")
+	flags.StringVar(&cfg.Cwd, "cwd", "", "working directory of the command")
+	flags.StringArrayVar(&cfg.Watch, "watch", nil, "directory to watch for changes, which may be outside the current one (default the command's working directory)")
+	flags.DurationVar(&cfg.Poll, "poll", 0, "scan for changes in the background at this interval instead of on each request, for network filesystems and container mounts")
+	flags.IntVar(&cfg.PollWorkers, "poll-workers", 4, "number of directories read at once while polling")
+	flags.StringVar(&cfg.Go, "go", "", "only restart for changes to the files this Go main package is built from (default . when given without a value)")
+	flags.Lookup("go").NoOptDefVal = "."
+	flags.BoolVar(&cfg.Hash, "hash", false, "only restart when files' contents change, not just their mtimes")
+	flags.StringVar(&cfg.HashCache, "hash-cache", "", "file to keep --hash's file hashes in between runs")
+	flags.StringArrayVarP(&cfg.IgnoreDirs, "ignore", "x", []string{"node_modules", "log", "tmp", "vendor", ".make"}, "directories to ignore, as patterns relative to each watched directory")
+	flags.StringArrayVar(&cfg.EnvFiles, "env-file", nil, "dotenv file to read the command's environment from. Later files override earlier ones")
+	flags.StringArrayVarP(&cfg.Env, "env", "e", nil, "set KEY=value in the command's environment, or pass KEY through from tulpa's")
+	flags.BoolVar(&cfg.ClearEnv, "clear-env", false, "start the command with only PATH from tulpa's environment")
+	flags.StringVar(&cfg.Shell, "shell", "/bin/sh -c", "shell the command is run with, such as \"bash -lc\" for a login shell")
+	flags.BoolVar(&cfg.NoShell, "no-shell", false, "run the command's arguments directly instead of through a shell")
+	flags.StringVar(&cfg.Restart, "restart", server.RestartNever, "restart the command when it exits on its own: never, on-failure or always")
+	flags.IntVar(&cfg.RestartMax, "restart-max", 5, "restarts in a row before a crashing command is left stopped until files change, or 0 for no limit")
+	flags.DurationVar(&cfg.RestartBackoff, "restart-backoff", 500*time.Millisecond, "wait before restarting a crashed command, doubled for each restart in a row")
 	flags.BoolVarP(&cfg.Wait, "wait", "w", false, "wait for command to finish before serving request")
 	flags.BoolVarP(&cfg.Verbose, "verbose", "v", false, "print extra debugging info")
 
@@ -52,8 +114,11 @@ func Execute() {
 	}
 }
 
-func start(cfg *server.Config, args []string) error {
+func start(cfg *server.Config, args []string, summary bool) error {
 	cfg.Initialize()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
 	stop := make(chan os.Signal, 1)
 	signal.Notify(
 		stop,
@@ -63,7 +128,10 @@ func start(cfg *server.Config, args []string) error {
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
 	)
-	srv := server.New(cfg, args)
+	srv, err := server.New(cfg, args)
+	if err != nil {
+		return err
+	}
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -74,5 +142,8 @@ func start(cfg *server.Config, args []string) error {
 
 	<-stop
 	srv.Stop()
+	if summary {
+		srv.PrintSummary()
+	}
 	return nil
 }
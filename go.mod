@@ -4,6 +4,8 @@ go 1.13
 
 require (
 	github.com/MichaelTJones/walk v0.0.0-20161122175330-4748e29d5718
+	github.com/andybalholm/brotli v1.0.4
+	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/fatih/color v1.10.0
 	github.com/spf13/cobra v1.1.3
 )
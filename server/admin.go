@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminPrefix is the path prefix of tulpa's own endpoints. Requests under it
+// are answered by tulpa and never reach the application.
+const adminPrefix = "/__tulpa/"
+
+func isAdminRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, adminPrefix)
+}
+
+func newAdminHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"status", s.handleStatus)
+	mux.HandleFunc(adminPrefix+"network", s.proxy.network.handle)
+	mux.HandleFunc(adminPrefix+"metrics", s.proxy.metrics.handle(s.proxy.queue))
+	if st := s.proxy.static; st != nil && st.reload != nil {
+		mux.HandleFunc(adminPrefix+"livereload", st.reload.handle)
+	}
+	if in := s.proxy.inspector; in != nil {
+		mux.HandleFunc(adminPrefix+"inspect", in.handleList)
+		mux.HandleFunc(adminPrefix+"inspect.json", in.handleJSON)
+		mux.HandleFunc(adminPrefix+"inspect.har", in.handleHAR)
+	}
+	return mux
+}
+
+type status struct {
+	Proxy string       `json:"proxy"`
+	Apps  []*appStatus `json:"apps"`
+	Queue *queueStats  `json:"queue"`
+}
+
+type appStatus struct {
+	Name     string `json:"name,omitempty"`
+	Route    string `json:"route"`
+	Upstream string `json:"upstream"`
+	AppPort  int    `json:"app_port,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// LastExit describes how the app's command last ended.
+	LastExit string `json:"last_exit,omitempty"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := &status{Proxy: s.Addr().String(), Queue: s.proxy.queue.stats()}
+	for _, a := range s.apps {
+		as := &appStatus{
+			Name:     a.route.Name,
+			Route:    a.route.String(),
+			Upstream: a.up.String(),
+			AppPort:  a.up.port(),
+			Error:    a.getError(),
+		}
+		if a.managed() {
+			as.LastExit = a.runner.lastExitStatus()
+		}
+		st.Apps = append(st.Apps, as)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	ignoreError(enc.Encode(st))
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+)
+
+// app is an upstream behind a route, and the process that serves it. Apps
+// without a command are proxied to, but not managed.
+type app struct {
+	cfg       *Config
+	route     *Route
+	up        *upstream
+	rp        *httputil.ReverseProxy
+	runner    *runner
+	watcher   *watcher
+	debounced func(f func())
+	mu        sync.Mutex
+	errStr    string
+	restarts  int64
+	// reloaded are the files whose changes caused the last restart.
+	reloaded []string
+}
+
+func newApp(cfg *Config, rt *Route) (*app, error) {
+	up, err := cfg.upstream()
+	if err != nil {
+		return nil, err
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(up.url)
+	rp.Transport = up.transport()
+	rp.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	a := &app{
+		cfg:   cfg,
+		route: rt,
+		up:    up,
+		rp:    rp,
+	}
+	rp.Director = a.director(rp.Director)
+	rp.ModifyResponse = a.modifyResponse
+	if len(rt.Command) > 0 {
+		a.runner = newRunner(cfg, rt.Command)
+		a.watcher = newWatcher(cfg)
+		a.debounced = newDebouncer(cfg)
+	}
+	return a, nil
+}
+
+func (a *app) managed() bool { return a.runner != nil }
+
+// restarted counts a restart caused by changes to files.
+func (a *app) restarted(files []string) {
+	a.mu.Lock()
+	a.reloaded = files
+	a.mu.Unlock()
+	atomic.AddInt64(&a.restarts, 1)
+}
+
+func (a *app) reloadedFiles() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reloaded
+}
+
+func (a *app) restartCount() int64 { return atomic.LoadInt64(&a.restarts) }
+
+func (a *app) setError(err error) {
+	a.cfg.Debug("proxy: error mode")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errStr = err.Error()
+}
+
+func (a *app) clearError() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errStr = ""
+}
+
+func (a *app) getError() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.errStr
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheHeader says whether a response came from the cache.
+	cacheHeader = "X-Tulpa-Cache"
+	// cacheBodyLimit is the largest response body that is cached.
+	cacheBodyLimit = 1 << 20
+	// cacheMaxEntries is the number of responses kept. Expired entries, then
+	// arbitrary ones, are evicted to make room.
+	cacheMaxEntries = 512
+)
+
+// cache keeps app responses in memory for as long as their Cache-Control or
+// Expires headers allow, like a shared cache or CDN would.
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// vary holds the request headers each url's response varies on.
+	vary map[string][]string
+}
+
+type cacheEntry struct {
+	app     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newCache(cfg *Config) *cache {
+	if !cfg.Cache {
+		return nil
+	}
+	return &cache{
+		entries: make(map[string]*cacheEntry),
+		vary:    make(map[string][]string),
+	}
+}
+
+func cacheBaseKey(a *app, r *http.Request) string {
+	return a.route.Name + " " + r.Host + r.URL.RequestURI()
+}
+
+func cacheKey(base string, vary []string, r *http.Request) string {
+	key := base
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(r.Header[name], ", ")
+	}
+	return key
+}
+
+// cacheableRequest returns true if the request may be answered from, and
+// stored in, the cache.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	_, noStore := cc["no-store"]
+	return !noCache && !noStore
+}
+
+func (c *cache) get(a *app, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	base := cacheBaseKey(a, r)
+	e := c.entries[cacheKey(base, c.vary[base], r)]
+	if e == nil || time.Now().After(e.expires) {
+		return nil
+	}
+	return e
+}
+
+func (c *cache) put(a *app, r *http.Request, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= cacheMaxEntries {
+		c.evict()
+	}
+	base := cacheBaseKey(a, r)
+	vary := varyHeaders(e.header)
+	c.vary[base] = vary
+	c.entries[cacheKey(base, vary, r)] = e
+}
+
+func (c *cache) evict() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < cacheMaxEntries {
+			return
+		}
+		delete(c.entries, k)
+	}
+}
+
+// clear drops the app's responses, as they may be stale once it restarts.
+func (c *cache) clear(a *app) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.app == a.route.Name {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// serve writes a cached response, or 304 if the request's validators match.
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set(cacheHeader, "HIT")
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+
+	if notModified(r, h) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	_, err := w.Write(e.body)
+	ignoreError(err)
+}
+
+// cacheWriter answers conditional requests with 304 on the app's behalf, and
+// keeps cacheable responses as they're written.
+type cacheWriter struct {
+	http.ResponseWriter
+	cache       *cache
+	app         *app
+	r           *http.Request
+	status      int
+	wroteHeader bool
+	notModified bool
+	header      http.Header
+	buf         *bytes.Buffer
+	expires     time.Time
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	h := w.Header()
+	if exp, ok := cacheExpiry(status, h); ok && cacheableRequest(w.r) {
+		// The header is kept before writers further out, like compression,
+		// change it.
+		w.header = h.Clone()
+		w.buf = &bytes.Buffer{}
+		w.expires = exp
+	}
+	h.Set(cacheHeader, "MISS")
+
+	if status == http.StatusOK && notModified(w.r, h) {
+		w.notModified = true
+		h.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		if w.buf.Len()+len(b) > cacheBodyLimit {
+			w.buf = nil
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	if w.notModified {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// store caches the response once it's been written.
+func (w *cacheWriter) store() {
+	if w.buf == nil {
+		return
+	}
+	w.cache.put(w.app, w.r, &cacheEntry{
+		app:     w.app.route.Name,
+		status:  w.status,
+		header:  w.header,
+		body:    w.buf.Bytes(),
+		stored:  time.Now(),
+		expires: w.expires,
+	})
+}
+
+// cacheExpiry returns when a response stops being fresh, and false if it
+// shouldn't be cached at all.
+func cacheExpiry(status int, h http.Header) (time.Time, bool) {
+	if status != http.StatusOK || h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return time.Time{}, false
+	}
+
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return time.Time{}, false
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return time.Time{}, false
+			}
+			return time.Now().Add(time.Duration(secs) * time.Second), true
+		}
+	}
+	if exp, err := http.ParseTime(h.Get("Expires")); err == nil && exp.After(time.Now()) {
+		return exp, true
+	}
+	return time.Time{}, false
+}
+
+func parseCacheControl(s string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		k := strings.ToLower(kv[0])
+		if len(kv) == 2 {
+			cc[k] = strings.Trim(kv[1], `"`)
+		} else {
+			cc[k] = ""
+		}
+	}
+	return cc
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// notModified returns true if the request's If-None-Match or
+// If-Modified-Since validators match the response headers.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastMod, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastMod.After(ims)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheExpiry(t *testing.T) {
+	tcs := []struct {
+		status int
+		header http.Header
+		ok     bool
+	}{
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}, ok: true},
+		{status: 200, header: http.Header{"Cache-Control": {"public, s-maxage=60, max-age=0"}}, ok: true},
+		{status: 200, header: http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, ok: true},
+		{status: 200, header: http.Header{}, ok: false},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=0"}}, ok: false},
+		{status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}}, ok: false},
+		{status: 200, header: http.Header{"Cache-Control": {"no-store"}}, ok: false},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=1"}}, ok: false},
+		{status: 500, header: http.Header{"Cache-Control": {"max-age=60"}}, ok: false},
+	}
+
+	for i, tc := range tcs {
+		if _, ok := cacheExpiry(tc.status, tc.header); ok != tc.ok {
+			t.Errorf("%d: expected %d %v to be cacheable: %t, got %t", i, tc.status, tc.header, tc.ok, ok)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastMod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := http.Header{"Etag": {`W/"abc"`}, "Last-Modified": {lastMod.Format(http.TimeFormat)}}
+
+	tcs := []struct {
+		header http.Header
+		want   bool
+	}{
+		{header: http.Header{"If-None-Match": {`"abc"`}}, want: true},
+		{header: http.Header{"If-None-Match": {`"xyz", W/"abc"`}}, want: true},
+		{header: http.Header{"If-None-Match": {"*"}}, want: true},
+		{header: http.Header{"If-None-Match": {`"xyz"`}}, want: false},
+		{header: http.Header{"If-Modified-Since": {lastMod.Format(http.TimeFormat)}}, want: true},
+		{header: http.Header{"If-Modified-Since": {lastMod.Add(-time.Hour).Format(http.TimeFormat)}}, want: false},
+		{header: http.Header{}, want: false},
+	}
+
+	for i, tc := range tcs {
+		r := &http.Request{Header: tc.header}
+		if got := notModified(r, h); got != tc.want {
+			t.Errorf("%d: expected %v to be not modified: %t, got %t", i, tc.header, tc.want, got)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	var hits int64
+	cfg := newTestConfig()
+	cfg.Cache = true
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "cool")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	get := func(etag string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", s.Addr()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode == 200 && string(b) != "cool" {
+			t.Fatalf("unexpected body %q", b)
+		}
+		return res
+	}
+
+	tcs := []struct {
+		etag   string
+		status int
+		cache  string
+		hits   int64
+	}{
+		{status: 200, cache: "MISS", hits: 1},
+		{status: 200, cache: "HIT", hits: 1},
+		{etag: `"v1"`, status: 304, cache: "HIT", hits: 1},
+		{etag: `"v0"`, status: 200, cache: "HIT", hits: 1},
+	}
+	for i, tc := range tcs {
+		res := get(tc.etag)
+		if res.StatusCode != tc.status || res.Header.Get(cacheHeader) != tc.cache {
+			t.Fatalf("%d: expected %d %s, got %d %s", i, tc.status, tc.cache, res.StatusCode, res.Header.Get(cacheHeader))
+		}
+		if n := atomic.LoadInt64(&hits); n != tc.hits {
+			t.Fatalf("%d: expected the app to be hit %d times, got %d", i, tc.hits, n)
+		}
+	}
+
+	s.proxy.cache.clear(s.apps[0])
+	res := get(`"v1"`)
+	if res.StatusCode != 304 || res.Header.Get(cacheHeader) != "MISS" {
+		t.Fatalf("expected 304 MISS after clearing the cache, got %d %s", res.StatusCode, res.Header.Get(cacheHeader))
+	}
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Fatal("expected the app to be hit again after clearing the cache, got", n)
+	}
+}
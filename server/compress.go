@@ -0,0 +1,102 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// acceptEncoding returns the compression the client prefers out of br and
+// gzip, or "" if it accepts neither.
+func acceptEncoding(r *http.Request) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		q[name] = weight
+	}
+
+	switch {
+	case q["br"] > 0 && q["br"] >= q["gzip"]:
+		return "br"
+	case q["gzip"] > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter compresses text responses the app didn't compress itself.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser
+	wroteHeader bool
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{ResponseWriter: w, encoding: acceptEncoding(r)}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if w.encoding != "" && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		if w.encoding == "br" {
+			w.enc = brotli.NewWriter(w.ResponseWriter)
+		} else {
+			w.enc = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// close flushes the rest of the compressed response.
+func (w *compressWriter) close() {
+	if w.enc != nil {
+		ignoreError(w.enc.Close())
+	}
+}
+
+// isCompressible returns true for text content, except event streams, which
+// must not be buffered.
+func isCompressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if ct == "" || strings.HasPrefix(ct, "text/event-stream") {
+		return false
+	}
+	return isTextContent(ct) || strings.Contains(ct, "svg")
+}
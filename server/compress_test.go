@@ -0,0 +1,97 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tcs := map[string]string{
+		"":                       "",
+		"gzip, deflate":          "gzip",
+		"gzip, deflate, br":      "br",
+		"br;q=0.5, gzip":         "gzip",
+		"br;q=0, gzip;q=0":       "",
+		"identity, GZIP;q=0.8":   "gzip",
+		"deflate, br;q=1.0, *;q": "br",
+	}
+	for accept, want := range tcs {
+		r := &http.Request{Header: http.Header{"Accept-Encoding": {accept}}}
+		if got := acceptEncoding(r); got != want {
+			t.Errorf("%q: expected %q, got %q", accept, want, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	body := strings.Repeat("cool ", 100)
+	cfg := newTestConfig()
+	cfg.Compress = true
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		fmt.Fprint(w, body)
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	tcs := []struct {
+		path     string
+		accept   string
+		encoding string
+	}{
+		{path: "/", accept: "gzip", encoding: "gzip"},
+		{path: "/", accept: "gzip, br", encoding: "br"},
+		{path: "/", accept: "", encoding: ""},
+		{path: "/image.png", accept: "gzip", encoding: ""},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.path+" "+tc.accept, func(t *testing.T) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", s.Addr(), tc.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", tc.accept)
+			res, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if enc := res.Header.Get("Content-Encoding"); enc != tc.encoding {
+				t.Fatalf("expected encoding %q, got %q", tc.encoding, enc)
+			}
+			var rd io.Reader = res.Body
+			switch tc.encoding {
+			case "gzip":
+				if rd, err = gzip.NewReader(res.Body); err != nil {
+					t.Fatal(err)
+				}
+			case "br":
+				rd = brotli.NewReader(res.Body)
+			}
+			b, err := ioutil.ReadAll(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != body {
+				t.Fatalf("unexpected body %q", b)
+			}
+		})
+	}
+}
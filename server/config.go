@@ -1,8 +1,10 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -11,25 +13,225 @@ import (
 
 var logPrefixColor = color.New(color.FgMagenta, color.Bold)
 
-func logPrefix() string {
+func logPrefix(name string) string {
+	if name != "" {
+		return logPrefixColor.Sprint("¤ " + name)
+	}
 	return logPrefixColor.Sprint("¤")
 }
 
 type Config struct {
-	AppPort    int
-	ProxyPort  int
+	AppPort   int
+	ProxyPort int
+	// Upstream is the address requests are proxied to. It defaults to
+	// http://localhost:<AppPort>, and can be a unix socket, as in
+	// unix:///path/to/sock.
+	Upstream string
+	// ProxySocket is a unix socket path the proxy listens on instead of
+	// ProxyPort.
+	ProxySocket string
+	// SocketEnv is the name of the environment variable the upstream socket
+	// path is passed to the command in.
+	SocketEnv string
+	// PortEnv is the name of the environment variable the upstream port is
+	// passed to the command in.
+	PortEnv string
+	// Routes send requests to other upstreams than the default one, each
+	// optionally with its own managed command. They're read from the config
+	// file.
+	Routes []*Route
+	// Cwd is the working directory of the command.
+	Cwd string
+	// Watch are the directories scanned for changes. They may be outside the
+	// current directory. Cwd, or the current directory, is scanned when it's
+	// empty.
+	Watch      []string
 	IgnoreDirs []string
 	Timeout    time.Duration
-	Debounce   time.Duration
+	// Poll scans for changes in the background at this interval, instead of
+	// on requests, for slow filesystems like network or container mounts. It's
+	// disabled when <= 0.
+	Poll time.Duration
+	// PollWorkers is the number of directories read at once while polling.
+	PollWorkers int
+	// Go is the main package of a Go app, like . or ./cmd/api. When it's set,
+	// only changes to the files the package is built from, and go.mod and
+	// go.sum, restart the app.
+	Go string
+	// Hash detects changes by files' contents instead of their mtimes, so
+	// files that are touched without changing don't restart the app.
+	Hash bool
+	// HashCache is a file the hashes are kept in between runs, so they don't
+	// all have to be computed on startup.
+	HashCache string
+	// MaxQueue is the number of requests that can wait for apps at once.
+	// Requests past it get a 503. It's unlimited when <= 0.
+	MaxQueue int
+	Debounce time.Duration
 	// DebouncePoll is the interval between watches while the request debouncer
 	// is saturated. It will be disabled if <= 0.
 	DebouncePoll  time.Duration
 	Latency       time.Duration
 	LatencyJitter time.Duration
-	Wait          bool
-	Verbose       bool
-	stdout        io.Writer
-	stderr        io.Writer
+	// Network is the name of a network profile to simulate, such as 3g, or
+	// a custom one given as down:up[:latency].
+	Network string
+	// Faults make a percentage of requests fail in various ways.
+	Faults []*Fault
+	// Rules set the latency and error rate of matching requests. They're
+	// read from the config file.
+	Rules []*Rule
+	// Mocks are responses served by tulpa instead of, or when it fails,
+	// the app. They're read from the config file.
+	Mocks []*Mock
+	// Rewrites change the headers of matching requests and responses. They're
+	// read from the config file.
+	Rewrites []*Rewrite
+	// CORS allows cross-origin requests from any origin, and answers
+	// preflight requests without asking the app.
+	CORS bool
+	// AuthUser is sent to the app in AuthHeader, replacing any value the
+	// client sent, to stand in for an auth gateway.
+	AuthUser   string
+	AuthHeader string
+	// Compress compresses text responses with brotli or gzip, when the client
+	// accepts it and the app didn't compress them.
+	Compress bool
+	// Cache keeps responses in memory as long as their Cache-Control allows,
+	// and answers conditional requests with 304, like a CDN would. It's
+	// cleared when the app restarts.
+	Cache bool
+	// Static is a directory of files served directly, such as a frontend's
+	// build output. It isn't watched for changes to restart the app.
+	Static string
+	// SPA serves Static's index.html for page loads that aren't files, so
+	// client-side routes work when the page is reloaded.
+	SPA bool
+	// LiveReload reloads pages served from Static when it changes.
+	LiveReload bool
+	// Trace is the OTLP/HTTP endpoint of an OpenTelemetry collector spans
+	// are sent to, like http://localhost:4318. Tracing is disabled when it's
+	// empty.
+	Trace string
+	// EnvFiles are dotenv files the command's environment is read from, in
+	// order. They're reread, and the command restarted, when they change.
+	EnvFiles []string
+	// Env are KEY=value vars set for the command, after EnvFiles. A bare KEY
+	// passes tulpa's own value through.
+	Env []string
+	// ClearEnv starts the command with only PATH from tulpa's environment.
+	ClearEnv bool
+	// Shell runs the command, and its flags, like "bash -lc". It defaults to
+	// "/bin/sh -c".
+	Shell string
+	// NoShell runs the command's args directly instead of through a shell, so
+	// args with spaces or quotes are passed as they are, and signals reach the
+	// app itself.
+	NoShell bool
+	// Restart is what happens when the command exits on its own: never,
+	// on-failure or always restart it. It doesn't apply with Wait.
+	Restart string
+	// RestartMax is the number of restarts in a row after which a crashing
+	// command is left stopped until files change. It's unlimited when <= 0.
+	RestartMax int
+	// RestartBackoff is the wait before the first restart of a crashed
+	// command. It doubles with each restart in a row.
+	RestartBackoff time.Duration
+	// AccessLog is the format requests are logged in: common, combined or
+	// json. Requests aren't logged when it's empty.
+	AccessLog string
+	// Inspect is the number of requests kept for the inspector at
+	// /__tulpa/inspect. The inspector is disabled when it's 0.
+	Inspect int
+	// Record is a file requests and responses are appended to, so they can
+	// be replayed later.
+	Record string
+	// Replay is the number of recorded requests to replay after each
+	// restart. Responses that differ from the recorded ones are reported.
+	Replay  int
+	Wait    bool
+	Verbose bool
+	stdout  io.Writer
+	stderr  io.Writer
+	// name identifies the route this config belongs to in log output.
+	name string
+}
+
+// Duration is a time.Duration that is read from json as a string like
+// "150ms", or a number of nanoseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// configFile is the format of the file passed with --config.
+type configFile struct {
+	Routes   []*Route   `json:"routes"`
+	Faults   []*Fault   `json:"faults"`
+	Rules    []*Rule    `json:"rules"`
+	Mocks    []*Mock    `json:"mocks"`
+	Rewrites []*Rewrite `json:"rewrites"`
+}
+
+// Load reads a JSON config file.
+func (c *Config) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cf := &configFile{}
+	if err := json.Unmarshal(b, cf); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	c.Routes = cf.Routes
+	for _, f := range cf.Faults {
+		if err := f.compile(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.Faults = append(c.Faults, cf.Faults...)
+	for _, rule := range cf.Rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.Rules = cf.Rules
+	for _, m := range cf.Mocks {
+		if err := m.compile(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.Mocks = cf.Mocks
+	for _, rw := range cf.Rewrites {
+		if err := rw.compile(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.Rewrites = cf.Rewrites
+	return nil
 }
 
 func (c *Config) Initialize() {
@@ -41,12 +243,84 @@ func (c *Config) Initialize() {
 	}
 }
 
+// Validate checks the config after Initialize, and picks a free app port if
+// there is neither a port nor an upstream.
+func (c *Config) Validate() error {
+	if err := checkRestart(c.Restart); err != nil {
+		return err
+	}
+
+	if c.AppPort == 0 && c.Upstream == "" {
+		port, err := freePort()
+		if err != nil {
+			return err
+		}
+		c.AppPort = port
+		c.Printf("using free app port %d", port)
+	}
+	return nil
+}
+
+func checkRestart(policy string) error {
+	switch policy {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	}
+	return fmt.Errorf("invalid restart policy %q: expected never, on-failure or always", policy)
+}
+
+// forRoute returns a copy of the config for the route's app. The settings of
+// the default app's command, like its working directory, watch directories
+// and static directory, are replaced by the route's own. Settings for every
+// command, like --env and --wait, apply to the route's too.
+func (c *Config) forRoute(rt *Route) (*Config, error) {
+	if err := checkRestart(rt.Restart); err != nil {
+		return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+	}
+
+	rc := *c
+	rc.name = rt.Name
+	rc.Upstream = rt.Upstream
+	rc.AppPort = rt.Port
+	rc.Cwd = rt.Cwd
+	rc.Go = rt.Go
+	rc.Watch = rt.Watch
+	rc.Static = ""
+	rc.SPA = false
+	rc.LiveReload = false
+	rc.Restart = rt.Restart
+	rc.Wait = c.Wait || rt.Wait
+	if len(rt.Ignore) > 0 {
+		rc.IgnoreDirs = rt.Ignore
+	}
+	// Each app keeps its own hashes.
+	if c.HashCache != "" {
+		rc.HashCache = c.HashCache + "." + rt.Name
+	}
+	rc.EnvFiles = append(append([]string(nil), c.EnvFiles...), rt.EnvFiles...)
+	rc.Env = append(append([]string(nil), c.Env...), rt.Env...)
+	rc.ClearEnv = c.ClearEnv || rt.ClearEnv
+
+	if rc.AppPort == 0 && rc.Upstream == "" {
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+		rc.AppPort = port
+	}
+	return &rc, nil
+}
+
+func (c *Config) upstream() (*upstream, error) {
+	return parseUpstream(c.Upstream, c.AppPort, c.name)
+}
+
 func (c *Config) Print(args ...interface{}) {
-	fmt.Fprintln(c.stdout, append([]interface{}{logPrefix()}, args...)...)
+	fmt.Fprintln(c.stdout, append([]interface{}{logPrefix(c.name)}, args...)...)
 }
 
 func (c *Config) Printf(msg string, args ...interface{}) {
-	finalMsg := fmt.Sprintf("%s %s\n", logPrefix(), msg)
+	finalMsg := fmt.Sprintf("%s %s\n", logPrefix(c.name), msg)
 	fmt.Fprintf(c.stdout, finalMsg, args...)
 }
 
@@ -54,13 +328,13 @@ func (c *Config) Debug(args ...interface{}) {
 	if !c.Verbose {
 		return
 	}
-	fmt.Fprintln(c.stdout, append([]interface{}{logPrefix()}, args...)...)
+	fmt.Fprintln(c.stdout, append([]interface{}{logPrefix(c.name)}, args...)...)
 }
 
 func (c *Config) Debugf(msg string, args ...interface{}) {
 	if !c.Verbose {
 		return
 	}
-	finalMsg := fmt.Sprintf("%s %s\n", logPrefix(), msg)
+	finalMsg := fmt.Sprintf("%s %s\n", logPrefix(c.name), msg)
 	fmt.Fprintf(c.stdout, finalMsg, args...)
 }
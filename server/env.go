@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readEnvFiles reads dotenv files, in order, so later files override earlier
+// ones.
+func readEnvFiles(paths []string) ([]string, error) {
+	var env []string
+	for _, path := range paths {
+		fileEnv, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	return env, nil
+}
+
+// readEnvFile reads KEY=value lines from a dotenv file. Lines may start with
+// export, values may be quoted, and # starts a comment outside of quotes.
+// Double quoted values may contain escapes like \n.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		val, err := parseEnvValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		env = append(env, key+"="+val)
+	}
+	return env, sc.Err()
+}
+
+func parseEnvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	switch q := s[0]; q {
+	case '"', '\'':
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if q == '"' && s[i] == '\\' {
+				i++
+			} else if s[i] == q {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quote in %s", s)
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after quoted value", rest)
+		}
+		if q == '\'' {
+			return s[1:end], nil
+		}
+		return strconv.Unquote(s[:end+1])
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// expandEnv returns --env values as KEY=value. A bare KEY passes tulpa's own
+// value through, which is useful with ClearEnv.
+func expandEnv(vars []string) []string {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		if strings.Contains(v, "=") {
+			env = append(env, v)
+		} else if val, ok := os.LookupEnv(v); ok {
+			env = append(env, v+"="+val)
+		}
+	}
+	return env
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, ".env")
+	writeFile(t, path, `# database
+DATABASE_URL=postgres://localhost/app
+export DEBUG=1
+
+EMPTY=
+SPACED = value with spaces # comment
+SINGLE='raw #\n'
+DOUBLE="line\nbreak \"quoted\"" # comment
+HASH=a#b
+`)
+	env, err := readEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DATABASE_URL=postgres://localhost/app",
+		"DEBUG=1",
+		"EMPTY=",
+		"SPACED=value with spaces",
+		`SINGLE=raw #\n`,
+		"DOUBLE=line\nbreak \"quoted\"",
+		"HASH=a#b",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Fatalf("expected %q, got %q", want, env)
+	}
+
+	for _, bad := range []string{"NOVALUE", "=value", "BAD KEY=value", `OPEN="value`, `AFTER="value" trailing`} {
+		writeFile(t, path, bad+"\n")
+		if _, err := readEnvFile(path); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestRunnerEnviron(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	base := filepath.Join(dir, ".env")
+	local := filepath.Join(dir, ".env.local")
+	writeFile(t, base, "A=base\nB=base\n")
+	writeFile(t, local, "B=local\n")
+	os.Setenv("TULPA_TEST_PASSTHROUGH", "cool")
+	defer os.Unsetenv("TULPA_TEST_PASSTHROUGH")
+
+	cfg := newTestConfig()
+	cfg.AppPort = 3456
+	cfg.PortEnv = "PORT"
+	cfg.EnvFiles = []string{base, local}
+	cfg.Env = []string{"C=flag", "TULPA_TEST_PASSTHROUGH", "TULPA_TEST_UNSET"}
+	cfg.ClearEnv = true
+	r := newRunner(cfg, []string{"cool"})
+	r.runs = 3
+	r.setChanged([]string{"a.go", "b.go"})
+	r.cmd = exec.Command("cool")
+	up, err := cfg.upstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := r.environ(up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		got[parts[0]] = parts[1]
+	}
+	want := map[string]string{
+		"PATH":                   os.Getenv("PATH"),
+		"A":                      "base",
+		"B":                      "local",
+		"C":                      "flag",
+		"TULPA_TEST_PASSTHROUGH": "cool",
+		"TULPA":                  "1",
+		"TULPA_RESTART_COUNT":    "2",
+		"TULPA_CHANGED_FILES":    "a.go" + string(os.PathListSeparator) + "b.go",
+		"PORT":                   "3456",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	cfg.EnvFiles = []string{filepath.Join(dir, "missing")}
+	if _, err := r.environ(up); err == nil {
+		t.Fatal("expected error for missing env file")
+	}
+}
+
+func TestWatcherEnvFiles(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ignored", ".env")
+	writeFile(t, path, "A=1\n")
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Watch = []string{dir}
+	cfg.IgnoreDirs = []string{filepath.Join(dir, "ignored")}
+	cfg.EnvFiles = []string{path}
+	w := newWatcher(cfg)
+	w.setLastRun(time.Now().Add(time.Second))
+	if w.scan() {
+		t.Fatal("expected no changes")
+	}
+
+	future := time.Now().Add(2 * time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !w.scan() {
+		t.Fatal("expected env file change")
+	}
+	if changed := w.changedFiles(); !reflect.DeepEqual(changed, []string{path}) {
+		t.Fatalf("expected %v changed, got %v", path, changed)
+	}
+}
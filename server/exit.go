@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// exitStatus describes how the command ended.
+type exitStatus struct {
+	code int
+	// signal is the signal that killed the command, or 0 if it exited.
+	signal   syscall.Signal
+	coreDump bool
+	runtime  time.Duration
+	// maxRSS is the command's peak resident set size, in bytes.
+	maxRSS int64
+}
+
+func newExitStatus(ps *os.ProcessState, ran time.Duration) *exitStatus {
+	st := &exitStatus{code: ps.ExitCode(), runtime: ran}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		st.signal = ws.Signal()
+		st.coreDump = ws.CoreDump()
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		st.maxRSS = int64(ru.Maxrss)
+		// Linux reports kilobytes, darwin bytes.
+		if runtime.GOOS != "darwin" {
+			st.maxRSS *= 1024
+		}
+	}
+	return st
+}
+
+func (st *exitStatus) success() bool {
+	return st.signal == 0 && st.code == 0
+}
+
+func (st *exitStatus) String() string {
+	var s string
+	if st.signal != 0 {
+		s = "killed by " + signalName(st.signal)
+		if st.coreDump {
+			s += " (core dumped)"
+		}
+	} else {
+		s = fmt.Sprintf("exited with status %d", st.code)
+	}
+	s += " after " + st.runtime.Round(time.Millisecond).String()
+	if st.maxRSS > 0 {
+		s += ", peak RSS " + formatBytes(st.maxRSS)
+	}
+	return s
+}
+
+// error returns an error describing how the command, or app, ended, followed
+// by what it wrote to stderr.
+func (st *exitStatus) error(what string, stderr *bytes.Buffer) error {
+	msg := what + " " + st.String()
+	if why := st.explain(); why != "" {
+		msg += ": " + why
+	}
+	if stderr.Len() > 0 {
+		msg += "\n\n" + stderr.String()
+	}
+	return errors.New(msg)
+}
+
+// explain returns why the command may have ended, if there's an obvious
+// reason.
+func (st *exitStatus) explain() string {
+	switch {
+	case st.signal == syscall.SIGKILL:
+		return "it may have run out of memory"
+	case st.success():
+		return "it should keep running to serve requests. Use --wait for commands that finish"
+	}
+	return ""
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
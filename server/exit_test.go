@@ -0,0 +1,91 @@
+package server
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitStatusString(t *testing.T) {
+	tcs := []struct {
+		st   *exitStatus
+		want string
+	}{
+		{st: &exitStatus{code: 1, runtime: 1500 * time.Millisecond}, want: "exited with status 1 after 1.5s"},
+		{st: &exitStatus{code: -1, signal: syscall.SIGSEGV, coreDump: true, runtime: time.Second, maxRSS: 3 << 20}, want: "killed by SIGSEGV (core dumped) after 1s, peak RSS 3.0MiB"},
+		{st: &exitStatus{code: -1, signal: syscall.Signal(63), maxRSS: 512}, want: "killed by signal 63 after 0s, peak RSS 512B"},
+	}
+	for _, tc := range tcs {
+		if got := tc.st.String(); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestRunnerUnexpectedExit(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	tcs := []struct {
+		name string
+		env  []string
+		kill bool
+		want []string
+	}{
+		{name: "clean exit", want: []string{"exited with status 0", "should keep running"}},
+		{name: "failure", env: []string{"_FAKEPROC_EXITCODE=3", "_FAKEPROC_STDERR=cool error"}, want: []string{"exited with status 3", "peak RSS", "cool error"}},
+		{name: "signal", env: []string{"_FAKEPROC_SLEEP=1m"}, kill: true, want: []string{"killed by SIGKILL", "out of memory"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _, _ := newTestConfigOutErr()
+			runner := newRunner(cfg, []string{"cool"})
+			runner.env = tc.env
+			defer close(runner.stop)
+			if err := runner.run(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.kill {
+				if err := syscall.Kill(runner.pid, syscall.SIGKILL); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case err := <-runner.errors:
+				for _, want := range tc.want {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("expected error to contain %q, got %q", want, err)
+					}
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timed out waiting for exit")
+			}
+			if !strings.HasPrefix(runner.lastExitStatus(), tc.want[0]) {
+				t.Errorf("expected last exit %q, got %q", tc.want[0], runner.lastExitStatus())
+			}
+		})
+	}
+}
+
+func TestRunnerKillIsExpected(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg, _, _ := newTestConfigOutErr()
+	runner := newRunner(cfg, []string{"cool"})
+	runner.env = []string{"_FAKEPROC_SLEEP=1m"}
+	defer close(runner.stop)
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+	runner.kill()
+
+	select {
+	case err := <-runner.errors:
+		t.Fatal("expected no error, got", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
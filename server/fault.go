@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	faultError    = "error"
+	faultReset    = "reset"
+	faultTruncate = "truncate"
+	faultTrickle  = "trickle"
+	faultTimeout  = "timeout"
+)
+
+// trickleChunk is the number of bytes written at a time by trickle faults.
+const trickleChunk = 64
+
+// Match selects requests by method, path, headers and query parameters.
+// Empty fields match anything.
+type Match struct {
+	Method string `json:"method"`
+	// Path is a glob. * matches within a path segment, ** across segments.
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header"`
+	Query  map[string]string `json:"query"`
+	pathRe *regexp.Regexp
+}
+
+func (m *Match) compile() error {
+	if m.Path == "" {
+		return nil
+	}
+	re, err := globRegexp(m.Path)
+	if err != nil {
+		return err
+	}
+	m.pathRe = re
+	return nil
+}
+
+func (m *Match) matches(r *http.Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, r.Method) {
+		return false
+	}
+	if m.pathRe != nil && !m.pathRe.MatchString(r.URL.Path) {
+		return false
+	}
+	for k, v := range m.Header {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		q := r.URL.Query()
+		for k, v := range m.Query {
+			if q.Get(k) != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// Fault makes a percentage of matching requests fail:
+//
+//	error     responds with Status (default 500) without asking the app
+//	reset     resets the connection
+//	truncate  cuts the app's response off halfway
+//	trickle   writes the app's response a few bytes every Delay (default 100ms)
+//	timeout   holds the request for Delay (default the request timeout) and
+//	          responds 504
+type Fault struct {
+	Match
+	Kind    string   `json:"kind"`
+	Percent float64  `json:"percent"`
+	Status  int      `json:"status"`
+	Delay   Duration `json:"delay"`
+}
+
+// ParseFault parses a fault from the command line, as
+// kind:percent[:path], like error:10 or reset:5:/api/**.
+func ParseFault(s string) (*Fault, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("fault %q: expected kind:percent[:path]", s)
+	}
+
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(parts[1], "%"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("fault %q: %w", s, err)
+	}
+	f := &Fault{Kind: parts[0], Percent: pct}
+	if len(parts) == 3 {
+		f.Path = parts[2]
+	}
+	if err := f.compile(); err != nil {
+		return nil, fmt.Errorf("fault %q: %w", s, err)
+	}
+	return f, nil
+}
+
+func (f *Fault) compile() error {
+	switch f.Kind {
+	case faultError, faultReset, faultTruncate, faultTrickle, faultTimeout:
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+	return f.Match.compile()
+}
+
+func (f *Fault) String() string {
+	s := fmt.Sprintf("%s %g%%", f.Kind, f.Percent)
+	if f.Method != "" {
+		s += " " + f.Method
+	}
+	if f.Path != "" {
+		s += " " + f.Path
+	}
+	return s
+}
+
+// pickFault returns the first matching fault that fires for the request, or
+// nil.
+func pickFault(faults []*Fault, r *http.Request) *Fault {
+	for _, f := range faults {
+		if f.matches(r) && rand.Float64()*100 < f.Percent {
+			return f
+		}
+	}
+	return nil
+}
+
+// inject carries out the faults that replace the app's response. It returns
+// false for faults that modify the app's response instead, which are applied
+// with wrap.
+func (f *Fault) inject(ctx context.Context, cfg *Config, w http.ResponseWriter) bool {
+	switch f.Kind {
+	case faultError:
+		status := f.Status
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+		_, err := w.Write([]byte("tulpa: injected error\n"))
+		ignoreError(err)
+		return true
+
+	case faultReset:
+		resetConn(w)
+		return true
+
+	case faultTimeout:
+		d := time.Duration(f.Delay)
+		if d <= 0 {
+			d = cfg.Timeout
+		}
+		ignoreError(sleepContext(ctx, d))
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, err := w.Write([]byte("tulpa: injected timeout\n"))
+		ignoreError(err)
+		return true
+	}
+	return false
+}
+
+// wrap returns a writer the app's response is written through.
+func (f *Fault) wrap(ctx context.Context, w http.ResponseWriter) http.ResponseWriter {
+	switch f.Kind {
+	case faultTruncate:
+		return &truncateWriter{ResponseWriter: w}
+	case faultTrickle:
+		d := time.Duration(f.Delay)
+		if d <= 0 {
+			d = 100 * time.Millisecond
+		}
+		return &trickleWriter{ResponseWriter: w, ctx: ctx, delay: d}
+	}
+	return w
+}
+
+// resetConn closes the client's connection without responding. tcp
+// connections are reset rather than closed cleanly.
+func resetConn(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tc, ok := unwrapConn(conn).(*net.TCPConn); ok {
+		ignoreError(tc.SetLinger(0))
+	}
+	ignoreError(conn.Close())
+}
+
+// unwrapConn returns the connection under any wrappers, like the network
+// profile's throttling.
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = u.Unwrap()
+	}
+}
+
+// truncateWriter writes half of the response, according to its
+// Content-Length, or 1KB of it if the length isn't known. The connection is
+// then aborted by abort.
+type truncateWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	limit       int
+	written     int
+	cut         bool
+}
+
+func (w *truncateWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.limit = 1024
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.limit = n / 2
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *truncateWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	rest := w.limit - w.written
+	if rest <= 0 {
+		w.cut = true
+		return len(b), nil
+	}
+	if rest < len(b) {
+		w.cut = true
+		b = b[:rest]
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += n
+	return len(b), err
+}
+
+// abort closes the connection if the response was cut short, so the client
+// sees an incomplete response.
+func (w *truncateWriter) abort() {
+	if !w.cut {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// trickleWriter writes the response a few bytes at a time.
+type trickleWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	delay time.Duration
+}
+
+func (w *trickleWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := trickleChunk
+		if n > len(b) {
+			n = len(b)
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		b = b[n:]
+
+		if err := sleepContext(w.ctx, w.delay); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
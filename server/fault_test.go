@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tcs := []struct {
+		match  *Match
+		method string
+		path   string
+		header http.Header
+		want   bool
+	}{
+		{match: &Match{}, method: "GET", path: "/", want: true},
+		{match: &Match{Method: "post"}, method: "POST", path: "/", want: true},
+		{match: &Match{Method: "POST"}, method: "GET", path: "/", want: false},
+		{match: &Match{Path: "/api/*"}, method: "GET", path: "/api/users", want: true},
+		{match: &Match{Path: "/api/*"}, method: "GET", path: "/api/users/1", want: false},
+		{match: &Match{Path: "/api/**"}, method: "GET", path: "/api/users/1", want: true},
+		{match: &Match{Path: "/*.js"}, method: "GET", path: "/app.js", want: true},
+		{match: &Match{Header: map[string]string{"X-Chaos": "1"}}, method: "GET", path: "/", header: http.Header{"X-Chaos": {"1"}}, want: true},
+		{match: &Match{Header: map[string]string{"X-Chaos": "1"}}, method: "GET", path: "/", want: false},
+		{match: &Match{Path: "/search", Query: map[string]string{"q": "slow"}}, method: "GET", path: "/search?q=slow", want: true},
+		{match: &Match{Path: "/search", Query: map[string]string{"q": "slow"}}, method: "GET", path: "/search?q=fast", want: false},
+	}
+
+	for i, tc := range tcs {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := tc.match.compile(); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.header != nil {
+				r.Header = tc.header
+			}
+			if got := tc.match.matches(r); got != tc.want {
+				t.Fatalf("expected %+v to match %s %s: %t, got %t", tc.match, tc.method, tc.path, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	f, err := ParseFault("reset:12.5%:/api/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Kind != faultReset || f.Percent != 12.5 || f.Path != "/api/**" {
+		t.Fatalf("unexpected fault %+v", f)
+	}
+
+	if _, err := ParseFault("explode:10"); err == nil {
+		t.Fatal("expected error for unknown fault kind")
+	}
+	if _, err := ParseFault("error"); err == nil {
+		t.Fatal("expected error for missing percentage")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	body := strings.Repeat("cool ", 100)
+	tcs := []struct {
+		fault *Fault
+		check func(t *testing.T, res *http.Response, err error)
+	}{
+		{
+			fault: &Fault{Kind: faultError, Status: 503},
+			check: func(t *testing.T, res *http.Response, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.StatusCode != 503 {
+					t.Fatal("expected 503, got", res.StatusCode)
+				}
+			},
+		},
+		{
+			fault: &Fault{Kind: faultReset},
+			check: func(t *testing.T, res *http.Response, err error) {
+				if err == nil {
+					t.Fatal("expected connection error, got", res.StatusCode)
+				}
+				if !errors.Is(err, syscall.ECONNRESET) {
+					t.Fatal("expected connection reset, got", err)
+				}
+			},
+		},
+		{
+			fault: &Fault{Kind: faultTruncate},
+			check: func(t *testing.T, res *http.Response, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ioutil.ReadAll(res.Body); err == nil {
+					t.Fatal("expected truncated body to fail reading")
+				}
+			},
+		},
+		{
+			fault: &Fault{Kind: faultTrickle, Delay: Duration(time.Millisecond)},
+			check: func(t *testing.T, res *http.Response, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != body {
+					t.Fatal("expected full body to trickle through")
+				}
+			},
+		},
+		{
+			fault: &Fault{Kind: faultTimeout, Delay: Duration(10 * time.Millisecond)},
+			check: func(t *testing.T, res *http.Response, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.StatusCode != http.StatusGatewayTimeout {
+					t.Fatal("expected 504, got", res.StatusCode)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.fault.Kind, func(t *testing.T) {
+			cfg := newTestConfig()
+			tc.fault.Percent = 100
+			cfg.Faults = []*Fault{tc.fault}
+
+			app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			})
+			defer app.Close()
+			s, errC := newTestServer(cfg, "cool")
+			defer s.Stop()
+			defer checkNoServerError(t, errC)
+
+			res, err := http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+			if err == nil {
+				defer res.Body.Close()
+			}
+			tc.check(t, res, err)
+		})
+	}
+}
+
+func TestLatencyNoJitter(t *testing.T) {
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Latency = time.Millisecond
+	p, err := newProxy(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.handleLatency(httptest.NewRequest("GET", "/", nil).Context(), nil)
+
+	if d := jitterLatency(time.Second, 0); d != time.Second {
+		t.Fatal("expected no jitter, got", d)
+	}
+
+	// Jitter goes both ways, and stays within bounds.
+	var above, below bool
+	for i := 0; i < 200; i++ {
+		d := jitterLatency(time.Second, 100*time.Millisecond)
+		if d <= 900*time.Millisecond || d >= 1100*time.Millisecond {
+			t.Fatal("expected latency within 1s ± 100ms, got", d)
+		}
+		above = above || d > time.Second
+		below = below || d < time.Second
+	}
+	if !above || !below {
+		t.Fatalf("expected jitter both ways, got above=%t below=%t", above, below)
+	}
+}
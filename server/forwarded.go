@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setForwarded tells the app how the client reached the proxy, with the
+// X-Forwarded-* headers and RFC 7239's Forwarded. host is the Host the
+// client sent. X-Forwarded-For is set by the reverse proxy.
+func setForwarded(r *http.Request, host string) {
+	proto := "http"
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+	if port := forwardedPort(r, host); port != "" {
+		r.Header.Set("X-Forwarded-Port", port)
+	}
+
+	fwd := "for=" + forwardedNode(r.RemoteAddr) + ";host=" + quoteForwarded(host) + ";proto=" + proto
+	if prior := r.Header.Get("Forwarded"); prior != "" {
+		fwd = prior + ", " + fwd
+	}
+	r.Header.Set("Forwarded", fwd)
+}
+
+// forwardedPort returns the port the client connected to, from the Host
+// header or the proxy's listener.
+func forwardedPort(r *http.Request, host string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return strconv.Itoa(addr.Port)
+	}
+	return ""
+}
+
+// forwardedNode formats a client address as a Forwarded node. IPv6
+// addresses are bracketed and quoted, and clients on unix sockets are
+// unknown.
+func forwardedNode(addr string) string {
+	host := remoteHost(addr)
+	if host == "-" {
+		return "unknown"
+	}
+	if strings.Contains(host, ":") {
+		return `"[` + host + `]"`
+	}
+	return host
+}
+
+// quoteForwarded quotes a Forwarded value if it isn't a plain token.
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, ":[]\" ") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// setAuthUser replaces any user header the client sent with the configured
+// user, the way an auth gateway in front of the app would.
+func setAuthUser(r *http.Request, cfg *Config) {
+	if cfg.AuthUser == "" || cfg.AuthHeader == "" {
+		return
+	}
+	r.Header.Set(cfg.AuthHeader, cfg.AuthUser)
+}
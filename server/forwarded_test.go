@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForwardedNode(t *testing.T) {
+	tcs := map[string]string{
+		"127.0.0.1:1234": "127.0.0.1",
+		"[::1]:1234":     `"[::1]"`,
+		"@":              "unknown",
+	}
+	for addr, want := range tcs {
+		if got := forwardedNode(addr); got != want {
+			t.Errorf("%q: expected %s, got %s", addr, want, got)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	cfg.AuthUser = "alice"
+	cfg.AuthHeader = "X-Forwarded-User"
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		ignoreError(json.NewEncoder(w).Encode(r.Header))
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", s.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.localhost:4000"
+	req.Header.Set("X-Forwarded-User", "mallory")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	h := http.Header{}
+	if err := json.NewDecoder(res.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "app.localhost:4000",
+		"X-Forwarded-Port":  "4000",
+		"X-Forwarded-User":  "alice",
+	}
+	for k, v := range want {
+		if got := h[k]; len(got) != 1 || got[0] != v {
+			t.Errorf("expected %s: %s, got %q", k, v, got)
+		}
+	}
+	if fwd := h.Get("Forwarded"); !strings.HasPrefix(fwd, "for=") || !strings.HasSuffix(fwd, `;host="app.localhost:4000";proto=http`) {
+		t.Errorf("unexpected Forwarded: %s", fwd)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// goGraph is the set of files a Go main package is built from: the non-test
+// files of the packages it depends on, and the module's go.mod and go.sum.
+// Changes to other files, like tests or unrelated commands, don't affect the
+// build.
+type goGraph struct {
+	files map[string]bool
+	// dirs are the directories of the packages, so new files added to them
+	// count too.
+	dirs     map[string]bool
+	packages int
+}
+
+// goPackage is the part of go list's output that's needed.
+type goPackage struct {
+	Dir        string
+	Standard   bool
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	CXXFiles   []string
+	HFiles     []string
+	SFiles     []string
+	SysoFiles  []string
+	EmbedFiles []string
+	Module     *struct {
+		GoMod string
+	}
+}
+
+// loadGoGraph runs go list on cfg.Go, from the command's working directory.
+func loadGoGraph(cfg *Config) (*goGraph, error) {
+	cmd := exec.Command("go", "list", "-e", "-deps", "-json", cfg.Go)
+	cmd.Dir = cfg.Cwd
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	g := &goGraph{files: make(map[string]bool), dirs: make(map[string]bool)}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg goPackage
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go list: %w", err)
+		}
+		if pkg.Standard || pkg.Dir == "" {
+			continue
+		}
+
+		g.packages++
+		dir := realPath(pkg.Dir)
+		g.dirs[dir] = true
+		for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.HFiles, pkg.SFiles, pkg.SysoFiles, pkg.EmbedFiles} {
+			for _, name := range files {
+				g.files[filepath.Join(dir, name)] = true
+			}
+		}
+		if pkg.Module != nil && pkg.Module.GoMod != "" {
+			modDir := realPath(filepath.Dir(pkg.Module.GoMod))
+			g.files[filepath.Join(modDir, "go.mod")] = true
+			g.files[filepath.Join(modDir, "go.sum")] = true
+		}
+	}
+	return g, nil
+}
+
+// realPath resolves the symlinks in path, so paths reached through different
+// links compare equal. The path is returned cleaned if it can't be resolved.
+func realPath(path string) string {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return real
+}
+
+// includes returns true if a change to the file, given as an absolute path
+// without symlinks, may change the build.
+func (g *goGraph) includes(path string) bool {
+	if g.files[path] {
+		return true
+	}
+	return strings.HasSuffix(path, ".go") && !strings.HasSuffix(path, "_test.go") && g.dirs[filepath.Dir(path)]
+}
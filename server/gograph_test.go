@@ -0,0 +1,97 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGoGraph(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go isn't installed")
+	}
+
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/app\n\ngo 1.13\n")
+	writeFile(t, filepath.Join(dir, "cmd", "api", "main.go"), "package main\n\nimport _ \"example.com/app/lib\"\n\nfunc main() {}\n")
+	writeFile(t, filepath.Join(dir, "cmd", "other", "main.go"), "package main\n\nfunc main() {}\n")
+	writeFile(t, filepath.Join(dir, "lib", "lib.go"), "package lib\n")
+	writeFile(t, filepath.Join(dir, "lib", "lib_test.go"), "package lib\n")
+	writeFile(t, filepath.Join(dir, "lib", "README.md"), "lib\n")
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Cwd = dir
+	cfg.Go = "./cmd/api"
+	g, err := loadGoGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		path     string
+		includes bool
+	}{
+		{path: "cmd/api/main.go", includes: true},
+		{path: "lib/lib.go", includes: true},
+		{path: "lib/new.go", includes: true},
+		{path: "go.mod", includes: true},
+		{path: "go.sum", includes: true},
+		{path: "lib/lib_test.go"},
+		{path: "lib/README.md"},
+		{path: "cmd/other/main.go"},
+	}
+	for _, tc := range tcs {
+		if includes := g.includes(filepath.Join(dir, tc.path)); includes != tc.includes {
+			t.Errorf("%s: expected includes %v, got %v", tc.path, tc.includes, includes)
+		}
+	}
+
+	cfg.Watch = []string{dir}
+	w := newWatcher(cfg)
+	w.updateGoGraph()
+	lastRun := time.Now()
+	for _, tc := range tcs {
+		path := filepath.Join(dir, tc.path)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		// Files touched by previous cases are older than the last run.
+		lastRun = lastRun.Add(time.Minute)
+		w.setLastRun(lastRun)
+		touched := lastRun.Add(time.Second)
+		if err := os.Chtimes(path, touched, touched); err != nil {
+			t.Fatal(err)
+		}
+		if modified := w.scan(); modified != tc.includes {
+			t.Errorf("%s: expected modified %v, got %v", tc.path, tc.includes, modified)
+		}
+	}
+
+	// Files match go list's, whether or not they're found through a symlink.
+	link := dir + "-link"
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(link)
+	cfg.Cwd = link
+	cfg.Watch = []string{filepath.Join(dir, "lib")}
+	w = newWatcher(cfg)
+	w.updateGoGraph()
+	lastRun = lastRun.Add(time.Minute)
+	w.setLastRun(lastRun)
+	touched := lastRun.Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "lib", "lib.go"), touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	if !w.scan() {
+		t.Error("expected lib/lib.go to be modified with a symlinked cwd")
+	}
+}
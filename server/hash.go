@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashCache keeps the contents hash of each watched file, so files that are
+// touched without changing, by formatters, code generators or editors, don't
+// restart the app. Files are only rehashed when their size or mtime changes.
+// The cache can be saved to a file so it carries over between runs.
+type hashCache struct {
+	path string
+	mu   sync.Mutex
+	// entries are the hashes as of the app's last successful run.
+	entries map[string]*hashEntry
+	// pending are the hashes found by scans since, and removed the files
+	// found deleted. They're only committed once the app runs, so changes
+	// are found again if it fails to.
+	pending map[string]*hashEntry
+	removed map[string]bool
+	dirty   bool
+}
+
+type hashEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    uint64    `json:"hash"`
+}
+
+// loadHashCache returns a cache read from path, or an empty one if path
+// doesn't exist yet. The cache isn't saved when path is empty.
+func loadHashCache(path string) (*hashCache, error) {
+	c := &hashCache{
+		path:    path,
+		entries: make(map[string]*hashEntry),
+		pending: make(map[string]*hashEntry),
+		removed: make(map[string]bool),
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// isCacheFile returns true if path is the cache's own file, which changes
+// with every scan.
+func (c *hashCache) isCacheFile(path string, info os.FileInfo) bool {
+	if c.path == "" || info.Name() != filepath.Base(c.path) {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	cacheAbs, err := filepath.Abs(c.path)
+	return err == nil && abs == cacheAbs
+}
+
+// changed returns true if the file is new, or its contents changed since the
+// app last ran.
+func (c *hashCache) changed(path string, info os.FileInfo) bool {
+	c.mu.Lock()
+	old := c.entries[path]
+	e := c.pending[path]
+	if old != nil && sameStat(old, info) {
+		delete(c.pending, path)
+		c.mu.Unlock()
+		return false
+	}
+	c.mu.Unlock()
+
+	if e == nil || !sameStat(e, info) {
+		h, err := hashFile(path)
+		if err != nil {
+			// The file was removed while scanning. It'll be reported as
+			// deleted next time.
+			return false
+		}
+		e = &hashEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: h}
+		c.mu.Lock()
+		c.pending[path] = e
+		c.mu.Unlock()
+	}
+	return old == nil || old.Hash != e.Hash
+}
+
+func sameStat(e *hashEntry, info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// deleted returns the files that were hashed, but aren't present anymore.
+func (c *hashCache) deleted(present map[string]bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var paths []string
+	c.removed = make(map[string]bool)
+	for path := range c.entries {
+		if !present[path] {
+			c.removed[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for path := range c.pending {
+		if !present[path] {
+			delete(c.pending, path)
+			if c.entries[path] == nil {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// commit makes the hashes found since the last commit the ones later changes
+// are compared to, once the app has run with them.
+func (c *hashCache) commit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, e := range c.pending {
+		c.entries[path] = e
+		c.dirty = true
+	}
+	for path := range c.removed {
+		delete(c.entries, path)
+		c.dirty = true
+	}
+	c.pending = make(map[string]*hashEntry)
+	c.removed = make(map[string]bool)
+}
+
+// save writes the cache to its file, if it changed.
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.path, b, 0644); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func hashFile(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := xxhash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
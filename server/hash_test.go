@@ -0,0 +1,105 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatcherHash(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	main := filepath.Join(dir, "main.go")
+	lib := filepath.Join(dir, "lib", "lib.go")
+	writeFile(t, main, "package main\n")
+	writeFile(t, lib, "package lib\n")
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Watch = []string{dir}
+	cfg.Hash = true
+	// The cache is inside the watched directory, but its changes don't count.
+	cfg.HashCache = filepath.Join(dir, ".tulpa-hashes")
+	w := newWatcher(cfg)
+	w.prime()
+
+	touch := func(path string) {
+		t.Helper()
+		future := time.Now().Add(time.Second)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(want ...string) {
+		t.Helper()
+		modified := w.scan()
+		if modified != (len(want) > 0) {
+			t.Fatalf("expected modified %v, got %v", len(want) > 0, modified)
+		}
+		if changed := w.changedFiles(); len(want) > 0 && !reflect.DeepEqual(changed, want) {
+			t.Fatalf("expected %v changed, got %v", want, changed)
+		}
+	}
+	// expectChanged scans, and runs the app successfully.
+	expectChanged := func(want ...string) {
+		t.Helper()
+		scan(want...)
+		w.ran(time.Now())
+	}
+
+	touch(main)
+	touch(lib)
+	expectChanged()
+
+	writeFile(t, lib, "package lib // changed\n")
+	expectChanged(lib)
+
+	// Changes are found again until the app runs successfully.
+	writeFile(t, main, "package main // broken\n")
+	scan(main)
+	scan(main)
+	w.ran(time.Now())
+	expectChanged()
+
+	added := filepath.Join(dir, "added.go")
+	writeFile(t, added, "package main\n")
+	expectChanged(added)
+
+	if err := os.Remove(added); err != nil {
+		t.Fatal(err)
+	}
+	expectChanged(added)
+
+	// The hashes carry over to the next run.
+	if _, err := os.Stat(cfg.HashCache); err != nil {
+		t.Fatal(err)
+	}
+	w = newWatcher(cfg)
+	if len(w.hashes.entries) != 2 {
+		t.Fatalf("expected 2 cached hashes, got %d", len(w.hashes.entries))
+	}
+	w.prime()
+	touch(main)
+	expectChanged()
+}
+
+func TestLoadHashCacheInvalid(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "hashes")
+	writeFile(t, path, "not json")
+	if _, err := loadHashCache(path); err == nil {
+		t.Fatal("expected error")
+	}
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Hash = true
+	cfg.HashCache = path
+	w := newWatcher(cfg)
+	if w.hashes == nil || w.hashes.path != path {
+		t.Fatal("expected an empty cache to replace the invalid one")
+	}
+}
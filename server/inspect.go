@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inspectBodyLimit is the number of bytes of each body the inspector keeps.
+const inspectBodyLimit = 64 << 10
+
+// inspector keeps the last exchanges that went through the proxy.
+type inspector struct {
+	mu    sync.Mutex
+	items []*exchange
+	next  int
+}
+
+func newInspector(n int) *inspector {
+	if n <= 0 {
+		return nil
+	}
+	return &inspector{items: make([]*exchange, n)}
+}
+
+func (in *inspector) add(ex *exchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.items[in.next] = ex.inspected()
+	in.next = (in.next + 1) % len(in.items)
+}
+
+// exchanges returns the recorded exchanges, newest first.
+func (in *inspector) exchanges() []*exchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	var res []*exchange
+	for i := 1; i <= len(in.items); i++ {
+		ex := in.items[(in.next-i+len(in.items))%len(in.items)]
+		if ex == nil {
+			break
+		}
+		res = append(res, ex)
+	}
+	return res
+}
+
+func (in *inspector) handleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ignoreError(inspectTemplate.Execute(w, in.exchanges()))
+}
+
+func (in *inspector) handleJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	ignoreError(enc.Encode(in.exchanges()))
+}
+
+func (in *inspector) handleHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="tulpa.har"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	ignoreError(enc.Encode(newHAR(in.exchanges())))
+}
+
+var inspectTemplate = template.Must(template.New("inspect").Funcs(template.FuncMap{
+	"ms": func(d time.Duration) string { return d.Round(time.Microsecond).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tulpa inspector</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em; }
+summary { cursor: pointer; font-family: monospace; padding: 2px 0; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; max-height: 30em; }
+.err { color: #b00; }
+.restarted { color: #a0a; }
+</style>
+</head>
+<body>
+<p><a href="inspect.json">json</a> · <a href="inspect.har">har</a></p>
+{{range .}}
+<details>
+<summary><span{{if ge .Status 400}} class="err"{{end}}>{{.Status}}</span> {{.Method}} {{.URL}} · {{ms .Upstream}}{{if .App}} · {{.App}}{{end}}{{if .Restarted}} · <span class="restarted">restarted</span>{{end}}{{if .Mock}} · mock{{end}}</summary>
+<h4>Request</h4>
+<pre>{{.Method}} {{.URL}} {{.Proto}}
+Host: {{.Host}}
+{{range $k, $v := .ReqHeader}}{{range $v}}{{$k}}: {{.}}
+{{end}}{{end}}
+{{.ReqBody}}</pre>
+<h4>Response</h4>
+<pre>{{.Status}}
+{{range $k, $v := .ResHeader}}{{range $v}}{{$k}}: {{.}}
+{{end}}{{end}}
+{{.ResBody}}</pre>
+{{if or .ReqTruncated .ResTruncated}}<p><em>body truncated</em></p>{{end}}
+</details>
+{{else}}
+<p>No requests yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// The types below are a subset of HAR 1.2, enough for browser devtools to
+// import.
+
+type harLog struct {
+	Log *har `json:"log"`
+}
+
+type har struct {
+	Version string      `json:"version"`
+	Creator *harCreator `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         *harRequest  `json:"request"`
+	Response        *harResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []*harNV     `json:"headers"`
+	QueryString []*harNV     `json:"queryString"`
+	Cookies     []*harNV     `json:"cookies"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+	PostData    *harPostData `json:"postData,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []*harNV    `json:"headers"`
+	Cookies     []*harNV    `json:"cookies"`
+	Content     *harContent `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	Blocked float64 `json:"blocked"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newHAR(exs []*exchange) *harLog {
+	h := &har{
+		Version: "1.2",
+		Creator: &harCreator{Name: "tulpa", Version: "1"},
+		Entries: []*harEntry{},
+	}
+
+	// HAR entries are conventionally oldest first.
+	for i := len(exs) - 1; i >= 0; i-- {
+		ex := exs[i]
+		u := &url.URL{Scheme: "http", Host: ex.Host}
+		if parsed, err := url.Parse(ex.URL); err == nil {
+			u.Path = parsed.Path
+			u.RawQuery = parsed.RawQuery
+		}
+
+		req := &harRequest{
+			Method:      ex.Method,
+			URL:         u.String(),
+			HTTPVersion: ex.Proto,
+			Headers:     harHeaders(ex.ReqHeader),
+			QueryString: []*harNV{},
+			Cookies:     []*harNV{},
+			HeadersSize: -1,
+			BodySize:    len(ex.ReqBody),
+		}
+		for k, vs := range u.Query() {
+			for _, v := range vs {
+				req.QueryString = append(req.QueryString, &harNV{Name: k, Value: v})
+			}
+		}
+		if ex.ReqBody != "" {
+			req.PostData = &harPostData{MimeType: ex.ReqHeader.Get("Content-Type"), Text: ex.ReqBody}
+		}
+
+		total := (ex.Queue + ex.Upstream).Seconds() * 1000
+		h.Entries = append(h.Entries, &harEntry{
+			StartedDateTime: ex.Start.Format(time.RFC3339Nano),
+			Time:            total,
+			Request:         req,
+			Response: &harResponse{
+				Status:      ex.Status,
+				StatusText:  http.StatusText(ex.Status),
+				HTTPVersion: ex.Proto,
+				Headers:     harHeaders(ex.ResHeader),
+				Cookies:     []*harNV{},
+				Content: &harContent{
+					Size:     ex.Size,
+					MimeType: ex.ResHeader.Get("Content-Type"),
+					Text:     ex.ResBody,
+				},
+				RedirectURL: ex.ResHeader.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    ex.Size,
+			},
+			Timings: &harTimings{
+				Blocked: ex.Queue.Seconds() * 1000,
+				Wait:    ex.Upstream.Seconds() * 1000,
+			},
+		})
+	}
+	return &harLog{Log: h}
+}
+
+func harHeaders(h http.Header) []*harNV {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := []*harNV{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			res = append(res, &harNV{Name: k, Value: v})
+		}
+	}
+	return res
+}
+
+// isTextContent reports whether a body of the content type can be shown in
+// the inspector.
+func isTextContent(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if ct == "" || strings.HasPrefix(ct, "text/") {
+		return true
+	}
+	for _, s := range []string{"json", "xml", "javascript", "x-www-form-urlencoded"} {
+		if strings.Contains(ct, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	ex := &exchange{
+		Start:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		RemoteAddr: "127.0.0.1:5555",
+		Method:     "GET",
+		URL:        "/cool?a=b",
+		Proto:      "HTTP/1.1",
+		ReqHeader:  http.Header{"User-Agent": {"curl"}},
+		Status:     200,
+		Size:       12,
+		Upstream:   3 * time.Millisecond,
+		Restarted:  true,
+	}
+
+	tcs := []struct {
+		format string
+		re     *regexp.Regexp
+	}{
+		{
+			format: accessLogCommon,
+			re:     regexp.MustCompile(`^127\.0\.0\.1 - - \[02/Jan/2020:03:04:05 \+0000\] "GET /cool\?a=b HTTP/1\.1" 200 12 upstream=3ms restarted\n$`),
+		},
+		{
+			format: accessLogCombined,
+			re:     regexp.MustCompile(`^127\.0\.0\.1 .* 200 12 "" "curl" upstream=3ms restarted\n$`),
+		},
+		{
+			format: accessLogJSON,
+			re:     regexp.MustCompile(`^\{.*"status":200,.*"upstream_ms":3,.*"restarted":true.*\}\n$`),
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.format, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			l, err := newAccessLog(tc.format, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.log(ex)
+
+			if !tc.re.MatchString(buf.String()) {
+				t.Fatalf("expected %q to match %s", buf.String(), tc.re)
+			}
+		})
+	}
+}
+
+func TestInspector(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	cfg := newTestConfig()
+	cfg.Inspect = 2
+
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "hello ", r.URL.Path)
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		res, err := http.Post(fmt.Sprintf("http://%s%s", s.Addr(), p), "text/plain", strings.NewReader("body "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://%s/__tulpa/inspect.har", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	h := &harLog{}
+	if err := json.NewDecoder(res.Body).Decode(h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Log.Entries) != 2 {
+		t.Fatal("expected 2 entries, got", len(h.Log.Entries))
+	}
+
+	entry := h.Log.Entries[1]
+	if !strings.HasSuffix(entry.Request.URL, "/c") {
+		t.Errorf("expected last entry to be /c, got %s", entry.Request.URL)
+	}
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != "body /c" {
+		t.Errorf("expected request body to be recorded, got %+v", entry.Request.PostData)
+	}
+	if entry.Response.Content.Text != "hello /c" {
+		t.Errorf("expected response body to be recorded, got %q", entry.Response.Content.Text)
+	}
+}
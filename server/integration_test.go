@@ -26,6 +26,7 @@ func TestIntegration(t *testing.T) {
 	tcs := []*testCase{
 		testSimple,
 		testDebounce,
+		testReloaded,
 	}
 
 	for _, tc := range tcs {
@@ -121,6 +122,32 @@ var testDebounce = &testCase{
 	},
 }
 
+var testReloaded = &testCase{
+	name:  "reloaded",
+	files: []string{"a", "b", "c"},
+	fn: func(t *testing.T) {
+		cfg, stdout, _ := newTestConfigOutErr()
+		app, srv, errC := newTestCase(cfg, successHandler, "cool")
+
+		defer app.Close()
+		defer srv.Stop()
+		checkNoServerError(t, errC)
+
+		header, _ := postRequest(t, srv)
+		if h := header.Get(reloadedHeader); h != "" {
+			t.Fatalf("expected no %s header, got %q", reloadedHeader, h)
+		}
+
+		touchFile(t, "b")
+		touchFile(t, "a")
+		header, _ = postRequest(t, srv)
+		if h := header.Get(reloadedHeader); h != "a, b" {
+			t.Fatalf("expected %s: a, b, got %q", reloadedHeader, h)
+		}
+		checkLinesMatch(t, stdout.String(), regexp.MustCompile(`fs modified \(a, b\), rerunning`), 1)
+	},
+}
+
 var successHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 })
@@ -134,7 +161,9 @@ func touchFile(t testing.TB, p string) {
 	}
 }
 
-func postRequest(t testing.TB, srv *Server) {
+// postRequest posts to the server, and returns the response's headers and
+// body.
+func postRequest(t testing.TB, srv *Server) (http.Header, string) {
 	t.Helper()
 
 	uri := fmt.Sprintf("http://%s", srv.Addr())
@@ -144,9 +173,14 @@ func postRequest(t testing.TB, srv *Server) {
 		t.Fatal(err)
 	}
 	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if res.StatusCode != 200 {
 		t.Fatal("expected 200, got", res.StatusCode)
 	}
+	return res.Header, string(b)
 }
 
 func checkLinesMatch(t testing.TB, s string, re *regexp.Regexp, n int) {
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// liveReloadScript is injected into html pages. It reloads the page when the
+// live reload endpoint sends a reload event.
+const liveReloadScript = `<script>new EventSource("` + adminPrefix + `livereload").addEventListener("reload", function() { location.reload(); });</script>`
+
+// liveReload tells connected browsers to reload over server-sent events.
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan struct{}]bool)}
+}
+
+// reload tells every connected browser to reload.
+func (lr *liveReload) reload() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for c := range lr.clients {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (lr *liveReload) handle(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := make(chan struct{}, 1)
+	lr.mu.Lock()
+	lr.clients[c] = true
+	lr.mu.Unlock()
+	defer func() {
+		lr.mu.Lock()
+		delete(lr.clients, c)
+		lr.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		select {
+		case <-c:
+			if _, err := fmt.Fprint(w, "event: reload\ndata: \n\n"); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// injectLiveReload adds the live reload script to an html page, before
+// </body> if there is one.
+func injectLiveReload(page []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if i < 0 {
+		return append(page, liveReloadScript...)
+	}
+
+	b := make([]byte, 0, len(page)+len(liveReloadScript))
+	b = append(b, page[:i]...)
+	b = append(b, liveReloadScript...)
+	return append(b, page[i:]...)
+}
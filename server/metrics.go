@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the histogram buckets of durations, in seconds. They
+// span quick proxied requests to slow builds.
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics measures what tulpa costs, per app, and exposes it in the
+// Prometheus text format.
+type metrics struct {
+	scans         *histogramVec
+	restarts      *histogramVec
+	buildFailures *counterVec
+	queue         *histogramVec
+	upstream      *histogramVec
+	retries       *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		scans:         newHistogramVec("tulpa_scan_duration_seconds", "Time spent scanning for file changes."),
+		restarts:      newHistogramVec("tulpa_restart_duration_seconds", "Time spent restarting the app after file changes and crashes, including builds with --wait."),
+		buildFailures: newCounterVec("tulpa_build_failures_total", "Number of times the app's command failed."),
+		queue:         newHistogramVec("tulpa_request_queue_seconds", "Time requests waited for scans and restarts."),
+		upstream:      newHistogramVec("tulpa_request_upstream_seconds", "Time requests spent in the app, including retries while it started."),
+		retries:       newCounterVec("tulpa_upstream_retries_total", "Number of times a request was retried because the app wasn't reachable."),
+	}
+}
+
+func (m *metrics) scanned(a *app, d time.Duration) {
+	m.scans.observe(a.route.Name, d.Seconds())
+}
+
+func (m *metrics) restarted(a *app, d time.Duration) {
+	m.restarts.observe(a.route.Name, d.Seconds())
+}
+
+func (m *metrics) buildFailed(a *app) {
+	m.buildFailures.inc(a.route.Name)
+}
+
+func (m *metrics) retried(a *app) {
+	m.retries.inc(a.route.Name)
+}
+
+func (m *metrics) request(ex *exchange) {
+	m.queue.observe(ex.App, ex.Queue.Seconds())
+	m.upstream.observe(ex.App, ex.Upstream.Seconds())
+}
+
+func (m *metrics) write(w io.Writer, q *queue) {
+	m.scans.write(w)
+	m.restarts.write(w)
+	m.buildFailures.write(w)
+	m.queue.write(w)
+	m.upstream.write(w)
+	m.retries.write(w)
+
+	st := q.stats()
+	writeMetric(w, "tulpa_queue_depth", "gauge", "Number of requests waiting for an app.", float64(st.Depth))
+	writeMetric(w, "tulpa_queue_rejected_total", "counter", "Number of requests turned away because the queue was full.", float64(st.Rejected))
+}
+
+func (m *metrics) handle(q *queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w, q)
+	}
+}
+
+// summary prints totals for each app.
+func (m *metrics) summary(apps []*app) {
+	for _, a := range apps {
+		name := a.route.Name
+		requests, queueSum := m.queue.total(name)
+		_, upstreamSum := m.upstream.total(name)
+		restarts, restartSum := m.restarts.total(name)
+		scans, scanSum := m.scans.total(name)
+
+		line := fmt.Sprintf("summary: %d requests", requests)
+		if requests > 0 {
+			line += fmt.Sprintf(" (queue avg %s, upstream avg %s)", avgDuration(queueSum, requests), avgDuration(upstreamSum, requests))
+		}
+		if a.managed() {
+			line += fmt.Sprintf(", %d scans (avg %s), %d restarts", scans, avgDuration(scanSum, scans), restarts)
+			if restarts > 0 {
+				line += fmt.Sprintf(" (avg %s)", avgDuration(restartSum, restarts))
+			}
+			line += fmt.Sprintf(", %d build failures", int(m.buildFailures.get(name)))
+		}
+		line += fmt.Sprintf(", %d retries", int(m.retries.get(name)))
+		a.cfg.Print(line)
+	}
+}
+
+func avgDuration(sum float64, n uint64) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(sum / float64(n) * float64(time.Second)).Round(time.Microsecond)
+}
+
+// counterVec is a counter labeled by app.
+type counterVec struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(app string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[app]++
+}
+
+func (c *counterVec) get(app string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[app]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, app := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{app=%s} %s\n", c.name, labelValue(app), formatFloat(c.values[app]))
+	}
+}
+
+// histogramVec is a histogram of durations labeled by app.
+type histogramVec struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string) *histogramVec {
+	return &histogramVec{name: name, help: help, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(app string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[app]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[app] = s
+	}
+	for i, le := range durationBuckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// total returns the number and sum of observations for the app.
+func (h *histogramVec) total(app string) (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.series[app]; s != nil {
+		return s.count, s.sum
+	}
+	return 0, 0
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	apps := make([]string, 0, len(h.series))
+	for app := range h.series {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		s := h.series[app]
+		label := labelValue(app)
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{app=%s,le=\"%s\"} %d\n", h.name, label, formatFloat(le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{app=%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{app=%s} %s\n", h.name, label, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{app=%s} %d\n", h.name, label, s.count)
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+}
+
+// labelEscaper escapes label values the way the Prometheus text format
+// expects. Unlike Go's quoting, it leaves other characters alone.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns the label value, quoted and escaped.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
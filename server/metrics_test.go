@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test.")
+	h.observe("api", 0.003)
+	h.observe("api", 0.2)
+	h.observe("api", 100)
+
+	buf := &bytes.Buffer{}
+	h.write(buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{app="api",le="0.001"} 0` + "\n",
+		`test_seconds_bucket{app="api",le="0.005"} 1` + "\n",
+		`test_seconds_bucket{app="api",le="0.25"} 2` + "\n",
+		`test_seconds_bucket{app="api",le="60"} 2` + "\n",
+		`test_seconds_bucket{app="api",le="+Inf"} 3` + "\n",
+		`test_seconds_sum{app="api"} 100.203` + "\n",
+		`test_seconds_count{app="api"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg, stdout, _ := newTestConfigOutErr()
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "cool")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(fmt.Sprintf("http://%s/__tulpa/metrics", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`tulpa_scan_duration_seconds_count{app=""} 1`,
+		`tulpa_request_queue_seconds_count{app=""} 1`,
+		`tulpa_request_upstream_seconds_count{app=""} 1`,
+		"tulpa_queue_depth 0",
+	} {
+		if !strings.Contains(string(b), want+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, b)
+		}
+	}
+
+	s.PrintSummary()
+	if !strings.Contains(stdout.String(), "summary: 1 requests") {
+		t.Fatal("expected summary to be printed, got", stdout.String())
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	c := newCounterVec("test_total", "Test.")
+	c.inc("a\\b\"c\nd é")
+	buf := &bytes.Buffer{}
+	c.write(buf)
+	want := `test_total{app="a\\b\"c\nd é"} 1` + "\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected output to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestMetricsCrashRestarts(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	cfg.Restart = RestartAlways
+	cfg.RestartBackoff = time.Millisecond
+	s, err := New(cfg, []string{"cool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake command exits right away, so it keeps being restarted.
+	errC := s.GoStart()
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if n, _ := s.proxy.metrics.restarts.total(""); n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected crash restarts to be measured")
+}
+
+func TestMetricsBuildFailures(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	s, err := New(cfg, []string{"cool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without --wait, the failure is reported after the command started.
+	s.apps[0].runner.env = []string{"_FAKEPROC_EXITCODE=1", "_FAKEPROC_STDERR=cool error"}
+	errC := s.GoStart()
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s.proxy.metrics.buildFailures.get("") > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the failed command to be counted")
+}
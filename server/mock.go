@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+const (
+	mockAlways   = "always"
+	mockFallback = "fallback"
+)
+
+// Mock is a response tulpa serves itself for matching requests. Mode is one
+// of:
+//
+//	always    the app is never asked
+//	fallback  the mock is served only when the app can't answer: it failed
+//	          to build or run, didn't respond before the timeout, or
+//	          responded with a 5xx status
+//
+// The response comes from File, which is read on every request, or Body. A
+// JSON Body is a template, so {"id": "{{.Query.Get `id`}}"} echoes the id
+// query parameter. A string Body is a template for a text response.
+type Mock struct {
+	Match
+	Mode           string            `json:"mode"`
+	Status         int               `json:"status"`
+	ResponseHeader map[string]string `json:"response_header"`
+	File           string            `json:"file"`
+	Body           json.RawMessage   `json:"body"`
+	tmpl           *template.Template
+	contentType    string
+}
+
+// mockRequest is what mock body templates are executed with.
+type mockRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+func (m *Mock) compile() error {
+	switch m.Mode {
+	case "":
+		m.Mode = mockAlways
+	case mockAlways, mockFallback:
+	default:
+		return fmt.Errorf("unknown mock mode %q", m.Mode)
+	}
+	if m.Status == 0 {
+		m.Status = http.StatusOK
+	}
+
+	hasBody := len(m.Body) > 0
+	if hasBody == (m.File != "") {
+		return errors.New("mock needs one of file or body")
+	}
+	if m.File != "" {
+		m.contentType = mime.TypeByExtension(filepath.Ext(m.File))
+	} else {
+		text := string(m.Body)
+		m.contentType = "application/json"
+		var s string
+		if err := json.Unmarshal(m.Body, &s); err == nil {
+			text = s
+			m.contentType = "text/plain; charset=utf-8"
+		}
+
+		tmpl, err := template.New("mock").Parse(text)
+		if err != nil {
+			return fmt.Errorf("mock body: %w", err)
+		}
+		m.tmpl = tmpl
+	}
+	return m.Match.compile()
+}
+
+func (m *Mock) String() string {
+	s := m.Mode
+	if m.Method != "" {
+		s += " " + m.Method
+	}
+	if m.Path != "" {
+		s += " " + m.Path
+	}
+	return s
+}
+
+func matchMock(mocks []*Mock, r *http.Request) *Mock {
+	for _, m := range mocks {
+		if m.matches(r) {
+			return m
+		}
+	}
+	return nil
+}
+
+// serve writes the mock response. Headers already set on w by the proxy are
+// kept, unless the mock sets them too.
+func (m *Mock) serve(w http.ResponseWriter, r *http.Request, body string) {
+	var b []byte
+	if m.File != "" {
+		var err error
+		b, err = ioutil.ReadFile(m.File)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("tulpa: mock: %v", err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		buf := &bytes.Buffer{}
+		err := m.tmpl.Execute(buf, &mockRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header,
+			Body:   body,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("tulpa: mock: %v", err), http.StatusInternalServerError)
+			return
+		}
+		b = buf.Bytes()
+	}
+
+	h := w.Header()
+	if m.contentType != "" {
+		h.Set("Content-Type", m.contentType)
+	}
+	for k, v := range m.ResponseHeader {
+		h.Set(k, v)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(m.Status)
+	_, err := w.Write(b)
+	ignoreError(err)
+}
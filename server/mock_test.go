@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestMockCompile(t *testing.T) {
+	tcs := []struct {
+		mock *Mock
+		ok   bool
+	}{
+		{mock: &Mock{Body: json.RawMessage(`{"ok": true}`)}, ok: true},
+		{mock: &Mock{File: "users.json", Mode: mockFallback}, ok: true},
+		{mock: &Mock{}, ok: false},
+		{mock: &Mock{File: "users.json", Body: json.RawMessage(`"hi"`)}, ok: false},
+		{mock: &Mock{Body: json.RawMessage(`"hi"`), Mode: "sometimes"}, ok: false},
+		{mock: &Mock{Body: json.RawMessage(`"{{.Nope"`)}, ok: false},
+	}
+
+	for i, tc := range tcs {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			err := tc.mock.compile()
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("expected error compiling %+v", tc.mock)
+			}
+		})
+	}
+}
+
+func TestMocks(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	usersPath := filepath.Join(dir, "users.json")
+	if err := ioutil.WriteFile(usersPath, []byte(`[{"id": 1}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig()
+	cfg.CORS = true
+	cfg.Mocks = []*Mock{
+		{Match: Match{Path: "/api/users/*"}, Body: json.RawMessage(`{"path": "{{.Path}}", "q": "{{.Query.Get ` + "`q`" + `}}"}`)},
+		{Match: Match{Path: "/api/users"}, Mode: mockFallback, File: usersPath},
+	}
+	for _, m := range cfg.Mocks {
+		if err := m.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/users" {
+			w.Header().Set("X-Broken", "1")
+			w.WriteHeader(500)
+			return
+		}
+		fmt.Fprint(w, "app")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	tcs := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{path: "/api/users/1?q=cool", status: 200, contentType: "application/json", body: `{"path": "/api/users/1", "q": "cool"}`},
+		{path: "/api/users", status: 200, contentType: "application/json", body: `[{"id": 1}]`},
+		{path: "/other", status: 200, body: "app"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", s.Addr(), tc.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", "http://localhost:3000")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, res.StatusCode)
+			}
+			if tc.contentType != "" && res.Header.Get("Content-Type") != tc.contentType {
+				t.Fatalf("expected content type %q, got %q", tc.contentType, res.Header.Get("Content-Type"))
+			}
+			if string(b) != tc.body {
+				t.Fatalf("expected body %q, got %q", tc.body, b)
+			}
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+				t.Fatalf("expected CORS headers, got origin %q", got)
+			}
+			if res.Header.Get("X-Broken") != "" {
+				t.Fatal("expected the held app response's headers to be dropped")
+			}
+		})
+	}
+}
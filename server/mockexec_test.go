@@ -72,6 +72,21 @@ func fakeProcess() {
 		}
 	}
 
+	if expectEnv := os.Getenv("_FAKEPROC_EXPECT_ENV"); expectEnv != "" {
+		parts := strings.SplitN(expectEnv, "=", 2)
+		if got := os.Getenv(parts[0]); len(parts) < 2 || got != parts[1] {
+			fmt.Fprintf(os.Stderr, "fakeprocess: assertion failed:\nexpected env: '%s',\n         got: '%s=%s'\n", expectEnv, parts[0], got)
+			os.Exit(assertFailedCode)
+		}
+	}
+
+	if expectCwd := os.Getenv("_FAKEPROC_EXPECT_CWD"); expectCwd != "" {
+		if cwd, err := os.Getwd(); err != nil || cwd != expectCwd {
+			fmt.Fprintf(os.Stderr, "fakeprocess: assertion failed:\nexpected cwd: '%s',\n         got: '%s'\n(err: %v)\n", expectCwd, cwd, err)
+			os.Exit(assertFailedCode)
+		}
+	}
+
 	fmt.Fprint(os.Stderr, os.Getenv("_FAKEPROC_STDERR"))
 	fmt.Fprint(os.Stdout, os.Getenv("_FAKEPROC_STDOUT"))
 
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkProfile simulates a slow network by capping the throughput of each
+// connection to the proxy, and adding latency to each request.
+type NetworkProfile struct {
+	Name string `json:"name"`
+	// Down and Up are in kilobits per second. 0 means unlimited.
+	Down    int      `json:"down_kbps"`
+	Up      int      `json:"up_kbps"`
+	Latency Duration `json:"latency"`
+}
+
+// networkProfiles are the named profiles, with the same numbers as browser
+// devtools and WebPageTest use.
+var networkProfiles = map[string]*NetworkProfile{
+	"slow-3g": {Name: "slow-3g", Down: 500, Up: 500, Latency: Duration(2000 * time.Millisecond)},
+	"3g":      {Name: "3g", Down: 1600, Up: 750, Latency: Duration(563 * time.Millisecond)},
+	"4g":      {Name: "4g", Down: 9000, Up: 9000, Latency: Duration(170 * time.Millisecond)},
+	"dsl":     {Name: "dsl", Down: 1500, Up: 384, Latency: Duration(50 * time.Millisecond)},
+}
+
+// ParseNetworkProfile returns a named profile, or parses a custom one given
+// as down:up[:latency], with throughput in kilobits per second, like
+// 1000:256:100ms. "off" and "" disable throttling and return nil.
+func ParseNetworkProfile(s string) (*NetworkProfile, error) {
+	if s == "" || s == "off" {
+		return nil, nil
+	}
+	if p, ok := networkProfiles[s]; ok {
+		return p, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("unknown network profile %q (available: %s, or down:up[:latency])", s, strings.Join(networkProfileNames(), ", "))
+	}
+	down, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("network profile %q: %w", s, err)
+	}
+	up, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("network profile %q: %w", s, err)
+	}
+	p := &NetworkProfile{Name: s, Down: down, Up: up}
+	if len(parts) == 3 {
+		lat, err := time.ParseDuration(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("network profile %q: %w", s, err)
+		}
+		p.Latency = Duration(lat)
+	}
+	return p, nil
+}
+
+func networkProfileNames() []string {
+	var names []string
+	for name := range networkProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// network holds the current profile, which can be changed at runtime.
+type network struct {
+	mu      sync.RWMutex
+	profile *NetworkProfile
+}
+
+func (n *network) get() *NetworkProfile {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.profile
+}
+
+func (n *network) set(p *NetworkProfile) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.profile = p
+}
+
+// delay waits for the profile's latency.
+func (n *network) delay(ctx context.Context) {
+	p := n.get()
+	if p == nil || p.Latency <= 0 {
+		return
+	}
+	ignoreError(sleepContext(ctx, time.Duration(p.Latency)))
+}
+
+func (n *network) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		p, err := ParseNetworkProfile(r.FormValue("profile"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.set(p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	ignoreError(enc.Encode(map[string]interface{}{
+		"profile":  n.get(),
+		"profiles": networkProfiles,
+	}))
+}
+
+func (n *network) listener(ln net.Listener) net.Listener {
+	return &throttledListener{Listener: ln, n: n}
+}
+
+type throttledListener struct {
+	net.Listener
+	n *network
+}
+
+func (ln *throttledListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &throttledConn{Conn: conn, n: ln.n}, nil
+}
+
+// throttledConn limits reads, which are uploads from the client's point of
+// view, and writes, which are downloads, to the current profile's
+// throughput.
+type throttledConn struct {
+	net.Conn
+	n *network
+}
+
+// Unwrap returns the connection being throttled.
+func (c *throttledConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	p := c.n.get()
+	if p == nil || p.Up <= 0 {
+		return c.Conn.Read(b)
+	}
+
+	if chunk := throttleChunk(p.Up); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	time.Sleep(throttleDelay(n, p.Up))
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		p := c.n.get()
+		if p == nil || p.Down <= 0 {
+			n, err := c.Conn.Write(b)
+			return written + n, err
+		}
+
+		chunk := throttleChunk(p.Down)
+		if chunk > len(b) {
+			chunk = len(b)
+		}
+		n, err := c.Conn.Write(b[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(throttleDelay(n, p.Down))
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttleChunk returns the number of bytes transferred at a time, about
+// 50ms worth at kbps.
+func throttleChunk(kbps int) int {
+	n := kbps * 1000 / 8 / 20
+	if n < 64 {
+		n = 64
+	}
+	return n
+}
+
+func throttleDelay(n, kbps int) time.Duration {
+	return time.Duration(float64(n) * 8 / float64(kbps*1000) * float64(time.Second))
+}
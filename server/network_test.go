@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNetworkProfile(t *testing.T) {
+	p, err := ParseNetworkProfile("3g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Down != 1600 || p.Up != 750 {
+		t.Fatalf("unexpected 3g profile %+v", p)
+	}
+
+	p, err = ParseNetworkProfile("1000:256:100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Down != 1000 || p.Up != 256 || time.Duration(p.Latency) != 100*time.Millisecond {
+		t.Fatalf("unexpected custom profile %+v", p)
+	}
+
+	p, err = ParseNetworkProfile("off")
+	if err != nil || p != nil {
+		t.Fatalf("expected off to disable throttling, got %+v (%v)", p, err)
+	}
+
+	if _, err := ParseNetworkProfile("carrier-pigeon"); err == nil {
+		t.Fatal("expected error for unknown profile")
+	}
+}
+
+func TestNetworkThrottle(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	cfg := newTestConfig()
+
+	body := strings.Repeat("x", 2500)
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	// 100kbps is 12.5KB/s, so the body takes 200ms to download.
+	res, err := http.PostForm(fmt.Sprintf("http://%s/__tulpa/network", s.Addr()), url.Values{"profile": {"100:100:50ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatal("expected 200 setting profile, got", res.StatusCode)
+	}
+
+	start := time.Now()
+	res, err = http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != body {
+		t.Fatal("unexpected body")
+	}
+	if took := time.Since(start); took < 250*time.Millisecond {
+		t.Fatalf("expected throttled request to take at least 250ms, took %s", took)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// poller scans for changes in the background, for filesystems without
+// reliable change events or fast walks, like network filesystems and
+// container bind mounts. It compares each file's size and mtime to the last
+// poll's, and collects the changed files, so scans at request time only have
+// to take them instead of touching the filesystem.
+type poller struct {
+	w        *watcher
+	interval time.Duration
+	workers  int
+	// stats are the files found by the last poll.
+	stats map[string]os.FileInfo
+	mu    sync.Mutex
+	dirty map[string]bool
+	stop  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+}
+
+func newPoller(w *watcher) *poller {
+	workers := w.cfg.PollWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	return &poller{
+		w:        w,
+		interval: w.cfg.Poll,
+		workers:  workers,
+		dirty:    make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// start polls once, to know what the files look like when the app starts,
+// then keeps polling in the background.
+func (p *poller) start() {
+	p.poll()
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *poller) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.poll()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *poller) close() {
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
+
+// take returns, and forgets, the files changed since it was last called.
+func (p *poller) take() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var changed []string
+	for path := range p.dirty {
+		changed = append(changed, path)
+	}
+	p.dirty = make(map[string]bool)
+	return changed
+}
+
+func (p *poller) poll() {
+	start := time.Now()
+	w := p.w
+	stats := p.walk()
+
+	changed := p.statEnvFiles(stats)
+	if w.hashes != nil {
+		present := make(map[string]bool, len(stats))
+		for path := range stats {
+			present[path] = true
+		}
+		changed = append(changed, w.hashes.deleted(present)...)
+	}
+	for path, info := range stats {
+		old, ok := p.stats[path]
+		if p.stats == nil || (ok && old.Size() == info.Size() && old.ModTime().Equal(info.ModTime())) {
+			continue
+		}
+		if !w.triggers(path, info) {
+			continue
+		}
+		if w.hashes != nil && !w.hashes.changed(path, info) {
+			continue
+		}
+		changed = append(changed, path)
+	}
+	for path, info := range p.stats {
+		if _, ok := stats[path]; !ok && w.triggers(path, info) {
+			changed = append(changed, path)
+		}
+	}
+
+	p.stats = stats
+
+	if len(changed) == 0 {
+		return
+	}
+	w.cfg.Debugf("poll found %d modified files in %v", len(changed), time.Since(start))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, path := range changed {
+		p.dirty[path] = true
+	}
+}
+
+// statEnvFiles adds the env files to stats, and returns the ones that
+// changed. They count even if they aren't watched, or aren't part of the Go
+// package graph.
+func (p *poller) statEnvFiles(stats map[string]os.FileInfo) []string {
+	var changed []string
+	for _, path := range p.w.cfg.EnvFiles {
+		path = filepath.Clean(path)
+		info, ok := stats[path]
+		if !ok {
+			var err error
+			if info, err = os.Stat(path); err != nil {
+				info = nil
+			} else {
+				stats[path] = info
+			}
+		}
+
+		old, existed := p.stats[path]
+		switch {
+		case p.stats == nil:
+		case info == nil:
+			if existed {
+				changed = append(changed, path)
+			}
+		case !existed || old.Size() != info.Size() || !old.ModTime().Equal(info.ModTime()):
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// walk stats the files in the watched directories, with a fixed pool of
+// workers reading directories from a queue.
+func (p *poller) walk() map[string]os.FileInfo {
+	type dir struct{ root, path string }
+	var (
+		mu    sync.Mutex
+		cond  = sync.NewCond(&mu)
+		queue []dir
+		// pending is the number of directories queued or being read. The walk
+		// is done when it's 0.
+		pending int
+		wg      sync.WaitGroup
+	)
+	stats := make(map[string]os.FileInfo)
+
+	for _, root := range p.w.roots() {
+		info, err := os.Stat(root)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			stats[filepath.Clean(root)] = info
+			continue
+		}
+		queue = append(queue, dir{root: root, path: filepath.Clean(root)})
+		pending++
+	}
+
+	visit := func(d dir) {
+		// Directories that can't be read are skipped.
+		infos, _ := ioutil.ReadDir(d.path)
+
+		var subdirs []dir
+		files := make(map[string]os.FileInfo, len(infos))
+		for _, info := range infos {
+			path := filepath.Join(d.path, info.Name())
+			if info.IsDir() {
+				if !p.w.shouldSkipDir(d.root, path) {
+					subdirs = append(subdirs, dir{root: d.root, path: path})
+				}
+				continue
+			}
+			if p.w.hashes != nil && p.w.hashes.isCacheFile(path, info) {
+				continue
+			}
+			files[path] = info
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for path, info := range files {
+			stats[path] = info
+		}
+		queue = append(queue, subdirs...)
+		pending += len(subdirs) - 1
+		cond.Broadcast()
+	}
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if len(queue) == 0 {
+					mu.Unlock()
+					return
+				}
+				d := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				visit(d)
+			}
+		}()
+	}
+	wg.Wait()
+	return stats
+}
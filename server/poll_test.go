@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	main := filepath.Join(dir, "main.go")
+	lib := filepath.Join(dir, "lib", "lib.go")
+	dep := filepath.Join(dir, "node_modules", "dep.js")
+	env := filepath.Join(dir, "..", filepath.Base(dir)+".env")
+	writeFile(t, main, "package main\n")
+	writeFile(t, lib, "package lib\n")
+	writeFile(t, dep, "")
+	writeFile(t, env, "A=1\n")
+	defer os.Remove(env)
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Watch = []string{dir}
+	cfg.IgnoreDirs = []string{"node_modules"}
+	cfg.EnvFiles = []string{env}
+	cfg.Poll = 10 * time.Millisecond
+	cfg.PollWorkers = 2
+	w := newWatcher(cfg)
+	w.start()
+	defer w.close()
+
+	if w.scan() {
+		t.Fatal("expected no changes after the first poll, got", w.changedFiles())
+	}
+
+	// waitChanged scans until the poller has found the changes.
+	waitChanged := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		var got []string
+		for time.Now().Before(deadline) {
+			if w.scan() {
+				got = append(got, w.changedFiles()...)
+				if got = uniquePaths(got); reflect.DeepEqual(got, want) {
+					w.ran(time.Now())
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %v changed, got %v", want, got)
+	}
+	touch := func(path string) {
+		t.Helper()
+		future := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	touch(main)
+	writeFile(t, lib, "package lib // changed\n")
+	touch(dep)
+	waitChanged(filepath.Clean(lib), filepath.Clean(main))
+
+	added := filepath.Join(dir, "lib", "added.go")
+	writeFile(t, added, "package lib\n")
+	if err := os.Remove(main); err != nil {
+		t.Fatal(err)
+	}
+	waitChanged(filepath.Clean(added), filepath.Clean(main))
+
+	writeFile(t, env, "A=2\n")
+	waitChanged(filepath.Clean(env))
+}
+
+func TestPollerWalk(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	want := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			path := filepath.Join(dir, fmt.Sprint("a", i), fmt.Sprint("b", j), "c", "file.go")
+			writeFile(t, path, "package c\n")
+			want[path] = true
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		cfg, _, _ := newTestConfigOutErr()
+		cfg.Watch = []string{dir}
+		cfg.Poll = time.Hour
+		cfg.PollWorkers = workers
+		stats := newWatcher(cfg).poller.walk()
+		if len(stats) != len(want) {
+			t.Fatalf("%d workers: expected %d files, got %d", workers, len(want), len(stats))
+		}
+		for path := range stats {
+			if !want[path] {
+				t.Fatalf("%d workers: unexpected file %s", workers, path)
+			}
+		}
+	}
+}
+
+func TestPollerHash(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	main := filepath.Join(dir, "main.go")
+	writeFile(t, main, "package main\n")
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Watch = []string{dir}
+	cfg.Hash = true
+	cfg.Poll = time.Hour
+	w := newWatcher(cfg)
+	w.prime()
+	w.start()
+	defer w.close()
+
+	poll := func(want ...string) {
+		t.Helper()
+		w.poller.poll()
+		modified := w.scan()
+		if modified != (len(want) > 0) {
+			t.Fatalf("expected modified %v, got %v", len(want) > 0, w.changedFiles())
+		}
+		if len(want) > 0 && !reflect.DeepEqual(w.changedFiles(), want) {
+			t.Fatalf("expected %v changed, got %v", want, w.changedFiles())
+		}
+		w.ran(time.Now())
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(main, future, future); err != nil {
+		t.Fatal(err)
+	}
+	poll()
+
+	if err := os.Remove(main); err != nil {
+		t.Fatal(err)
+	}
+	poll(filepath.Clean(main))
+	if len(w.hashes.entries) != 0 {
+		t.Fatal("expected the deleted file's hash to be forgotten")
+	}
+
+	// Recreated with the same contents, it's new again.
+	writeFile(t, main, "package main\n")
+	poll(filepath.Clean(main))
+}
@@ -1,15 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,31 +18,71 @@ import (
 // 	return srv.start()
 // }
 
+const (
+	// reloadedHeader lists the changed files that restarted the app while
+	// the request waited.
+	reloadedHeader = "X-Tulpa-Reloaded"
+	// reloadedHeaderMax is the number of files listed in reloadedHeader.
+	reloadedHeaderMax = 20
+)
+
 type proxy struct {
-	cfg      *Config
-	ln       net.Listener
-	rp       *httputil.ReverseProxy
-	requests chan struct{}
-	unpause  chan struct{}
-	errStr   string
+	cfg       *Config
+	ln        net.Listener
+	apps      []*app
+	admin     http.Handler
+	accessLog *accessLog
+	inspector *inspector
+	recording *recording
+	network   *network
+	static    *static
+	cache     *cache
+	queue     *queue
+	metrics   *metrics
+	tracer    *tracer
+	requests  chan *scanRequest
+	// unpause receives the files whose changes restarted the app while the
+	// request was waiting, or nil if it wasn't restarted.
+	unpause chan []string
 }
 
-func newProxy(cfg *Config) *proxy {
-	url, err := url.Parse(fmt.Sprintf("%s:%v", "http://localhost", cfg.AppPort))
+func newProxy(cfg *Config, apps []*app) (*proxy, error) {
+	al, err := newAccessLog(cfg.AccessLog, cfg.stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := newRecording(cfg.Record, cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := ParseNetworkProfile(cfg.Network)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	rp := httputil.NewSingleHostReverseProxy(url)
-	rp.ErrorLog = log.New(ioutil.Discard, "", 0)
+	tr, err := newTracer(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	p := &proxy{
-		cfg:      cfg,
-		rp:       rp,
-		requests: make(chan struct{}),
-		unpause:  make(chan struct{}),
+		cfg:       cfg,
+		apps:      apps,
+		accessLog: al,
+		inspector: newInspector(cfg.Inspect),
+		recording: rec,
+		network:   &network{profile: profile},
+		static:    newStatic(cfg),
+		cache:     newCache(cfg),
+		queue:     newQueue(cfg.MaxQueue),
+		metrics:   newMetrics(),
+		tracer:    tr,
+		requests:  make(chan *scanRequest),
+		unpause:   make(chan []string),
 	}
-	return p
+	return p, nil
 }
 
 func (p *proxy) start(ready chan error) error {
@@ -55,23 +93,146 @@ func (p *proxy) start(ready chan error) error {
 		},
 	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", p.cfg.ProxyPort))
+	ln, err := listen(p.cfg.ProxySocket, p.cfg.ProxyPort)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
 	p.ln = ln
+	ln = p.network.listener(ln)
 	if ready != nil {
 		ready <- nil
 	}
 
-	p.cfg.Printf("proxying requests on %s to :%d", ln.Addr(), p.cfg.AppPort)
+	for _, a := range p.apps {
+		if len(p.apps) == 1 && a.route.Path == "" && a.route.Host == "" {
+			a.cfg.Printf("proxying requests on %s to %s", ln.Addr(), a.up)
+		} else {
+			a.cfg.Printf("proxying requests on %s %s to %s", ln.Addr(), a.route, a.up)
+		}
+	}
 	return srv.Serve(ln)
 }
 
+// match returns the app of the most specific route matching the request, or
+// nil if no route matches.
+func (p *proxy) match(r *http.Request) *app {
+	var best *app
+	for _, a := range p.apps {
+		if !a.route.matches(r) {
+			continue
+		}
+		if best == nil || a.route.score() > best.route.score() {
+			best = a
+		}
+	}
+	return best
+}
+
 func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.requests <- struct{}{}
-	<-p.unpause
+	if p.admin != nil && isAdminRequest(r) {
+		p.admin.ServeHTTP(w, r)
+		return
+	}
+
+	ex := newExchange(r)
+	rec := &recorder{ResponseWriter: w}
+	if p.capture() {
+		rec.body = &bytes.Buffer{}
+	}
+
+	var a *app
+
+	// Faults may abort the handler by panicking, so the exchange is logged in
+	// a defer.
+	defer func() {
+		ex.finish(rec)
+		if p.accessLog != nil {
+			p.accessLog.log(ex)
+		}
+		if p.inspector != nil {
+			p.inspector.add(ex)
+		}
+		if p.recording != nil && a != nil && !ex.Mock && !ex.Static && ex.Fault == "" {
+			p.recording.add(ex)
+		}
+		if a != nil {
+			p.metrics.request(ex)
+		}
+	}()
+
+	a = p.match(r)
+	if a != nil {
+		ex.App = a.route.Name
+		release, ok := p.queue.enter()
+		if !ok {
+			a.cfg.Debugf("queue full, rejecting %s %s", r.Method, r.URL)
+			rejectQueued(rec)
+			return
+		}
+		defer release()
+
+		ctx, span := p.tracer.start(withTraceparent(r), "tulpa.request")
+		span.setKind(spanKindServer)
+		span.setAttr("http.method", r.Method)
+		span.setAttr("http.target", r.URL.RequestURI())
+		span.setAttr("tulpa.app", a.route.Name)
+		defer func() {
+			span.setAttr("http.status_code", strconv.Itoa(rec.status))
+			span.finish()
+		}()
+		p.serve(a, rec, r.WithContext(ctx), ex, release)
+	} else {
+		http.NotFound(rec, r)
+	}
+}
+
+// capture returns true if request and response bodies should be kept.
+func (p *proxy) capture() bool {
+	return p.inspector != nil || p.recording != nil
+}
+
+// serve handles a request for the app. release takes the request out of the
+// queue, once it no longer waits for the app to scan or restart.
+func (p *proxy) serve(a *app, w http.ResponseWriter, r *http.Request, ex *exchange, release func()) {
+	if p.cfg.CORS && isPreflight(r) {
+		handlePreflight(w, r)
+		return
+	}
+
+	r = withRewrites(p.cfg.Rewrites, r)
+	rule := matchRule(p.cfg.Rules, r)
+	fault := pickFault(p.cfg.Faults, r)
+	if fault == nil && rule != nil {
+		fault = rule.fault()
+	}
+	mock := matchMock(p.cfg.Mocks, r)
+	a.route.strip(r)
+
+	// Static files belong to the default app. Routes' configs don't have a
+	// static directory.
+	if p.static != nil && a.cfg.Static != "" {
+		if h := p.static.handler(r); h != nil {
+			ex.Static = true
+			p.serveStatic(h, w, r)
+			return
+		}
+	}
+
+	// Requests that are always mocked don't wait for the app.
+	if a.managed() && (mock == nil || mock.Mode != mockAlways) {
+		qctx, span := p.tracer.start(r.Context(), "queue")
+		p.requests <- &scanRequest{app: a, ctx: qctx}
+		reloaded := <-p.unpause
+		ex.Restarted = len(reloaded) > 0
+		span.setAttr("tulpa.restarted", strconv.FormatBool(ex.Restarted))
+		span.finish()
+		if ex.Restarted {
+			w.Header().Set(reloadedHeader, summarizeFiles(reloaded, reloadedHeaderMax))
+		}
+	}
+	ex.Queue = time.Since(ex.Start)
+	release()
 
 	ctx, cancel := context.WithTimeout(r.Context(), p.cfg.Timeout)
 	defer cancel()
@@ -86,16 +247,75 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s := string(b)
+	if p.capture() {
+		ex.setRequestBody(s)
+	}
+
+	start := time.Now()
+	defer func() { ex.Upstream = time.Since(start) }()
+
+	p.network.delay(r.Context())
 
+	if fault != nil {
+		ex.Fault = fault.Kind
+		a.cfg.Printf("injecting fault: %s", fault)
+		if fault.inject(r.Context(), p.cfg, w) {
+			return
+		}
+		w = fault.wrap(r.Context(), w)
+		if tw, ok := w.(*truncateWriter); ok {
+			defer tw.abort()
+		}
+	}
+
+	if mock != nil && mock.Mode == mockAlways {
+		p.handleLatency(r.Context(), rule)
+		ex.Mock = true
+		p.serveMock(mock, w, r, s)
+		return
+	}
+
+	if p.cfg.Compress {
+		cw := newCompressWriter(w, r)
+		defer cw.close()
+		w = cw
+	}
+	if p.cache != nil {
+		if cacheableRequest(r) {
+			if e := p.cache.get(a, r); e != nil {
+				e.serve(w, r)
+				return
+			}
+		}
+		cw := &cacheWriter{ResponseWriter: w, cache: p.cache, app: a, r: r}
+		defer cw.store()
+		w = cw
+	}
+
+	// The time spent retrying until the app is reachable is traced as
+	// readiness.
+	var ready *span
 	for {
-		if ok := p.forward(w, r, s); ok {
+		attempt := time.Now()
+		if ok := p.forward(a, w, r, s, rule, mock, ex); ok {
+			ready.finishAt(attempt)
 			return
 		}
+		p.metrics.retried(a)
+		if ready == nil {
+			_, ready = p.tracer.startAt(r.Context(), "readiness", attempt)
+		}
 
 		select {
 		case <-time.After(50 * time.Millisecond):
 		case <-ctx.Done():
-			p.cfg.Print("timeout reached")
+			a.cfg.Print("timeout reached")
+			ready.setError(ctx.Err())
+			ready.finish()
+			if mock != nil {
+				p.fallback(a, mock, w, r, s, ex)
+				return
+			}
 			w.WriteHeader(http.StatusBadGateway)
 			_, err := w.Write([]byte("Connection Refused\n"))
 			ignoreError(err)
@@ -104,38 +324,110 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (p *proxy) forward(w http.ResponseWriter, r *http.Request, body string) bool {
-	if len(p.errStr) > 0 {
+// forward proxies the request to the app. It returns false if the app
+// couldn't be reached, and the request should be retried. Fallback mocks are
+// served in place of the app's errors.
+func (p *proxy) forward(a *app, w http.ResponseWriter, r *http.Request, body string, rule *Rule, mock *Mock, ex *exchange) bool {
+	if errStr := a.getError(); len(errStr) > 0 {
+		if mock != nil {
+			p.fallback(a, mock, w, r, body, ex)
+			return true
+		}
 		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte(p.errStr))
+		_, err := w.Write([]byte(errStr))
 		ignoreError(err)
 		return true
 	}
 
-	p.handleLatency(r.Context())
+	p.handleLatency(r.Context(), rule)
 
 	r.Body = &stringReader{Reader: strings.NewReader(body)}
-	writer := &proxyWriter{res: w}
-	p.rp.ServeHTTP(writer, r)
+	writer := &proxyWriter{res: w, holdErrors: mock != nil}
+	if writer.holdErrors {
+		writer.header = make(http.Header)
+	}
+	ctx, span := p.tracer.start(r.Context(), "upstream")
+	span.setKind(spanKindClient)
+	a.rp.ServeHTTP(writer, r.WithContext(ctx))
 	// fmt.Println("proxyWriter.status", writer.status)
+	// Attempts that didn't reach the app are part of the readiness span.
+	if writer.status != http.StatusBadGateway {
+		span.setAttr("http.status_code", strconv.Itoa(writer.status))
+		span.finish()
+	}
+	if writer.held() {
+		p.fallback(a, mock, w, r, body, ex)
+		return true
+	}
 
 	// If the request is "successful" - as in the server responded in
 	// some way, return the response to the client.
 	return writer.status != http.StatusBadGateway
 }
 
-func (p *proxy) handleLatency(ctx context.Context) {
-	latency := p.cfg.Latency
-	jitter := p.cfg.LatencyJitter
-	if latency <= 0 {
-		return
+func (p *proxy) fallback(a *app, mock *Mock, w http.ResponseWriter, r *http.Request, body string, ex *exchange) {
+	a.cfg.Printf("app unavailable, serving mock %s", mock)
+	ex.Mock = true
+	p.serveMock(mock, w, r, body)
+}
+
+// serveMock serves the mock with the response rewrites and CORS headers the
+// app's response would have had.
+func (p *proxy) serveMock(mock *Mock, w http.ResponseWriter, r *http.Request, body string) {
+	p.setResponseHeaders(w.Header(), r)
+	mock.serve(w, r, body)
+}
+
+// setResponseHeaders applies the response rewrites and CORS headers to
+// responses tulpa serves itself.
+func (p *proxy) setResponseHeaders(h http.Header, r *http.Request) {
+	for _, rw := range getRewrites(r).rewrites {
+		rw.ResponseHeader.apply(h)
 	}
+	if p.cfg.CORS {
+		setCORSHeaders(r, h)
+	}
+}
+
+// serveStatic serves a static file with the response rewrites, CORS headers
+// and compression the app's responses get.
+func (p *proxy) serveStatic(h http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	p.setResponseHeaders(w.Header(), r)
+	if p.cfg.Compress {
+		cw := newCompressWriter(w, r)
+		defer cw.close()
+		w = cw
+	}
+	h(w, r)
+}
 
-	r := time.Duration(rand.Intn(int(jitter)))
-	if rand.Intn(1) == 0 {
+// jitterLatency returns the latency, plus or minus up to jitter.
+func jitterLatency(latency, jitter time.Duration) time.Duration {
+	var r time.Duration
+	if jitter > 0 {
+		r = time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if rand.Intn(2) == 0 {
 		r *= -1
 	}
-	dur := latency + r
+	return latency + r
+}
+
+// handleLatency waits for the latency of the matching rule, or of --latency
+// if there isn't one.
+func (p *proxy) handleLatency(ctx context.Context, rule *Rule) {
+	var dur time.Duration
+	if rule != nil {
+		if rule.Latency == nil {
+			return
+		}
+		dur = rule.Latency.sample()
+	} else {
+		if p.cfg.Latency <= 0 {
+			return
+		}
+		dur = jitterLatency(p.cfg.Latency, p.cfg.LatencyJitter)
+	}
 	if dur <= 0 {
 		return
 	}
@@ -147,39 +439,54 @@ func (p *proxy) handleLatency(ctx context.Context) {
 	}
 }
 
-func (p *proxy) setError(err error) {
-	p.cfg.Debug("proxy: error mode")
-	p.errStr = err.Error()
-}
-
-func (p *proxy) clearError() {
-	p.errStr = ""
-}
-
 // Wrapper around http.ResponseWriter. Since the proxy works rather naively -
 // it just retries requests over and over until it gets a response from the app
 // server - we can't use the ResponseWriter that is passed to the handler
 // because you cannot call WriteHeader multiple times.
+//
+// When holdErrors is set, 5xx responses are held back as well, so a fallback
+// mock can be served instead. The app's headers are then kept in header until
+// the response is let through, so a held response leaves none behind.
 type proxyWriter struct {
-	res    http.ResponseWriter
-	status int
+	res        http.ResponseWriter
+	header     http.Header
+	status     int
+	holdErrors bool
+}
+
+// held returns true if an app error response was held back.
+func (w *proxyWriter) held() bool {
+	return w.holdErrors && w.status >= 500 && w.status != http.StatusBadGateway
 }
 
 func (w *proxyWriter) WriteHeader(status int) {
 	// fmt.Println("WriteHeader", status)
 	w.status = status
-	if status == 502 {
+	if status == 502 || w.held() {
 		return
 	}
 
+	if w.header != nil {
+		h := w.res.Header()
+		for k, vs := range w.header {
+			h[k] = vs
+		}
+		w.header = nil
+	}
 	w.res.WriteHeader(status)
 }
 
 func (w *proxyWriter) Write(body []byte) (int, error) {
+	if w.status == http.StatusBadGateway || w.held() {
+		return len(body), nil
+	}
 	return w.res.Write(body)
 }
 
 func (w *proxyWriter) Header() http.Header {
+	if w.header != nil {
+		return w.header
+	}
 	return w.res.Header()
 }
 
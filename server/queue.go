@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueRetryAfter is the Retry-After, in seconds, of requests turned away
+// because the queue is full.
+const queueRetryAfter = "1"
+
+// queue limits how many requests can wait for apps at once. A request waits
+// from the time it reaches the proxy until its app has been scanned for
+// changes, and restarted if needed. Past the limit, requests are turned away with
+// a 503 instead of piling up.
+type queue struct {
+	limit    int64
+	depth    int64
+	peak     int64
+	rejected int64
+
+	mu        sync.Mutex
+	waits     int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+type queueStats struct {
+	Limit    int64   `json:"limit"`
+	Depth    int64   `json:"depth"`
+	Peak     int64   `json:"peak"`
+	Rejected int64   `json:"rejected"`
+	Waits    int64   `json:"waits"`
+	WaitAvg  float64 `json:"wait_avg_ms"`
+	WaitMax  float64 `json:"wait_max_ms"`
+}
+
+func newQueue(limit int) *queue {
+	return &queue{limit: int64(limit)}
+}
+
+// enter adds a request to the queue. It returns false if the queue is full.
+// Otherwise release must be called once the request is done waiting. It may
+// be called more than once.
+func (q *queue) enter() (release func(), ok bool) {
+	depth := atomic.AddInt64(&q.depth, 1)
+	if q.limit > 0 && depth > q.limit {
+		atomic.AddInt64(&q.depth, -1)
+		atomic.AddInt64(&q.rejected, 1)
+		return nil, false
+	}
+	for {
+		peak := atomic.LoadInt64(&q.peak)
+		if depth <= peak || atomic.CompareAndSwapInt64(&q.peak, peak, depth) {
+			break
+		}
+	}
+
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&q.depth, -1)
+			q.observe(time.Since(start))
+		})
+	}, true
+}
+
+func (q *queue) observe(wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waits++
+	q.waitTotal += wait
+	if wait > q.waitMax {
+		q.waitMax = wait
+	}
+}
+
+func (q *queue) stats() *queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := &queueStats{
+		Limit:    q.limit,
+		Depth:    atomic.LoadInt64(&q.depth),
+		Peak:     atomic.LoadInt64(&q.peak),
+		Rejected: atomic.LoadInt64(&q.rejected),
+		Waits:    q.waits,
+		WaitMax:  q.waitMax.Seconds() * 1000,
+	}
+	if q.waits > 0 {
+		st.WaitAvg = (q.waitTotal / time.Duration(q.waits)).Seconds() * 1000
+	}
+	return st
+}
+
+func rejectQueued(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", queueRetryAfter)
+	http.Error(w, "tulpa: too many requests waiting for the app", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueLimit(t *testing.T) {
+	q := newQueue(2)
+	release1, ok := q.enter()
+	if !ok {
+		t.Fatal("expected first request to enter")
+	}
+	release2, ok := q.enter()
+	if !ok {
+		t.Fatal("expected second request to enter")
+	}
+	if _, ok := q.enter(); ok {
+		t.Fatal("expected third request to be rejected")
+	}
+
+	release1()
+	release1()
+	if _, ok := q.enter(); !ok {
+		t.Fatal("expected request to enter after one was released")
+	}
+	release2()
+
+	st := q.stats()
+	if st.Depth != 1 || st.Peak != 2 || st.Rejected != 1 || st.Waits != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestQueueReject(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg := newTestConfig()
+	cfg.MaxQueue = 1
+	cfg.Wait = true
+	cfg.Watch = []string{dir}
+	started := make(chan bool)
+	unblock := make(chan bool)
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-unblock
+		}
+	})
+	defer app.Close()
+	s, err := New(cfg, []string{"cool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restarts take a while, holding requests at the gate.
+	s.apps[0].runner.env = []string{"_FAKEPROC_SLEEP=1s"}
+	errC := s.GoStart()
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		res, err := http.Get(fmt.Sprintf("http://%s%s", s.Addr(), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// Requests the app is working on don't hold a place in the queue.
+	done := make(chan error)
+	go func() {
+		res, err := http.Get(fmt.Sprintf("http://%s/slow", s.Addr()))
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+	if res := get("/"); res.StatusCode != http.StatusOK {
+		t.Fatal("expected 200 while the app is busy, got", res.StatusCode)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests waiting for a restart do.
+	main := filepath.Join(dir, "main.go")
+	writeFile(t, main, "package main\n")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(main, future, future); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		res, err := http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for s.proxy.queue.stats().Depth == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	res := get("/")
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", res.StatusCode, res.Header)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://%s/__tulpa/status", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	st := &status{}
+	if err := json.NewDecoder(res.Body).Decode(st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Queue == nil || st.Queue.Rejected != 1 || st.Queue.Peak != 1 {
+		t.Fatalf("unexpected queue stats %+v", st.Queue)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+var (
+	replayOKColor  = color.New(color.FgGreen)
+	replayBadColor = color.New(color.FgRed, color.Bold)
+)
+
+// recording appends exchanges to a file, one json object per line. It also
+// keeps the last keep exchanges of each app in memory, so they can be
+// replayed after restarts without reading the whole file.
+type recording struct {
+	mu    sync.Mutex
+	f     *os.File
+	keep  int
+	tails map[string][]*exchange
+}
+
+func newRecording(path string, keep int) (*recording, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recording{f: f, keep: keep, tails: make(map[string][]*exchange)}
+	if keep > 0 {
+		// Exchanges recorded by earlier runs are replayed too. A last line
+		// cut short by a crash only ends the tail early.
+		ignoreError(eachRecorded(path, rec.keepTail))
+	}
+	return rec, nil
+}
+
+func (rec *recording) add(ex *exchange) {
+	b, err := json.Marshal(ex)
+	if err != nil {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err = rec.f.Write(append(b, '\n'))
+	ignoreError(err)
+	rec.keepTail(ex)
+}
+
+func (rec *recording) keepTail(ex *exchange) {
+	if rec.keep <= 0 {
+		return
+	}
+	tail := append(rec.tails[ex.App], ex)
+	if len(tail) > rec.keep {
+		tail = append([]*exchange(nil), tail[len(tail)-rec.keep:]...)
+	}
+	rec.tails[ex.App] = tail
+}
+
+// last returns the app's last recorded exchanges, oldest first.
+func (rec *recording) last(app string) []*exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]*exchange(nil), rec.tails[app]...)
+}
+
+// eachRecorded calls fn with each exchange of a recording, oldest first.
+func eachRecorded(path string, fn func(ex *exchange)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		ex := &exchange{}
+		if err := dec.Decode(ex); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fn(ex)
+	}
+}
+
+// readRecording returns the last n exchanges of a recording, oldest first.
+// All of them are returned if n <= 0.
+func readRecording(path string, n int) ([]*exchange, error) {
+	var exs []*exchange
+	err := eachRecorded(path, func(ex *exchange) {
+		exs = append(exs, ex)
+		if n > 0 && len(exs) > 2*n {
+			exs = append([]*exchange(nil), exs[len(exs)-n:]...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 && len(exs) > n {
+		exs = exs[len(exs)-n:]
+	}
+	return exs, nil
+}
+
+// replayer resends recorded requests to an app and compares the responses to
+// the recorded ones.
+type replayer struct {
+	cfg    *Config
+	app    *app
+	client *http.Client
+}
+
+func newReplayer(a *app) *replayer {
+	return &replayer{
+		cfg: a.cfg,
+		app: a,
+		client: &http.Client{
+			Transport: a.up.transport(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// regression is a replayed request whose response differs from the recorded
+// one.
+type regression struct {
+	ex   *exchange
+	diff string
+}
+
+// replay resends the exchanges, printing a summary, and returns the
+// regressions.
+func (rp *replayer) replay(exs []*exchange) []*regression {
+	var regs []*regression
+	for _, ex := range exs {
+		diff, err := rp.check(ex)
+		if err != nil {
+			diff = err.Error()
+		}
+		if diff != "" {
+			regs = append(regs, &regression{ex: ex, diff: diff})
+		}
+	}
+
+	if len(regs) == 0 {
+		rp.cfg.Printf("replay: %s", replayOKColor.Sprintf("%d requests, no regressions", len(exs)))
+		return nil
+	}
+
+	rp.cfg.Printf("replay: %s", replayBadColor.Sprintf("%d requests, %d regressions", len(exs), len(regs)))
+	for _, reg := range regs {
+		rp.cfg.Printf("  %s %s: %s", reg.ex.Method, reg.ex.URL, reg.diff)
+	}
+	return regs
+}
+
+// check resends a request and describes how the response differs from the
+// recorded one. It returns an empty string if they're the same.
+func (rp *replayer) check(ex *exchange) (string, error) {
+	res, err := rp.send(ex)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != ex.Status {
+		return fmt.Sprintf("status %d → %d", ex.Status, res.StatusCode), nil
+	}
+
+	// The recorded body is left out for binary and encoded responses.
+	if ex.ResBody == "" && ex.Size > 0 {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	body := string(b)
+	if ex.ResTruncated && len(body) > len(ex.ResBody) {
+		body = body[:len(ex.ResBody)]
+	}
+	return diffBodies(ex.ResBody, body), nil
+}
+
+// send resends the request, retrying until the upstream accepts connections
+// or the timeout is reached, as the app may still be starting.
+func (rp *replayer) send(ex *exchange) (*http.Response, error) {
+	body := ex.ReqBody
+	if ex.ReqBodyBase64 != "" {
+		b, err := base64.StdEncoding.DecodeString(ex.ReqBodyBase64)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+
+	deadline := time.Now().Add(rp.cfg.Timeout)
+	for {
+		req, err := rp.request(ex, body)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := rp.client.Do(req)
+		if err == nil && res.StatusCode != http.StatusBadGateway {
+			return res, nil
+		}
+		if err == nil {
+			res.Body.Close()
+			err = errors.New("bad gateway")
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// request rebuilds a recorded request as the proxy would send it to the app,
+// with its rewrites, forwarded and auth headers.
+func (rp *replayer) request(ex *exchange, body string) (*http.Request, error) {
+	req, err := http.NewRequest(ex.Method, ex.URL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = ex.ReqHeader.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Host = ex.Host
+	req.RemoteAddr = ex.RemoteAddr
+
+	a := rp.app
+	req = withRewrites(a.cfg.Rewrites, req)
+	a.route.strip(req)
+	a.rp.Director(req)
+	if host, _, err := net.SplitHostPort(ex.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	// Ask for an unencoded response so bodies can be compared.
+	req.Header.Del("Accept-Encoding")
+	return req, nil
+}
+
+// diffBodies describes the first line that differs between two bodies.
+func diffBodies(before, after string) string {
+	if before == after {
+		return ""
+	}
+
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var la, lb string
+		if i < len(a) {
+			la = a[i]
+		}
+		if i < len(b) {
+			lb = b[i]
+		}
+		if la != lb {
+			return fmt.Sprintf("body changed at line %d:\n    - %s\n    + %s", i+1, truncateLine(la), truncateLine(lb))
+		}
+	}
+	return "body changed"
+}
+
+func truncateLine(s string) string {
+	if len(s) > 120 {
+		return s[:120] + "…"
+	}
+	return s
+}
+
+// Replay resends the last n requests recorded to path to the upstream in
+// cfg, and returns the number of regressions.
+func Replay(cfg *Config, path string, n int) (int, error) {
+	exs, err := readRecording(path, n)
+	if err != nil {
+		return 0, err
+	}
+	a, err := newApp(cfg, &Route{})
+	if err != nil {
+		return 0, err
+	}
+
+	regs := newReplayer(a).replay(exs)
+	return len(regs), nil
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg, stdout, _ := newTestConfigOutErr()
+	cfg.Record = filepath.Join(dir, "tulpa.rec")
+
+	var broken int32
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" && atomic.LoadInt32(&broken) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		if r.URL.Path == "/body" && atomic.LoadInt32(&broken) == 1 {
+			fmt.Fprint(w, "line 1\nline two")
+			return
+		}
+		fmt.Fprint(w, "line 1\nline 2")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	for _, p := range []string{"/ok", "/status", "/body"} {
+		res, err := http.Get(fmt.Sprintf("http://%s%s", s.Addr(), p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	n, err := Replay(cfg, cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("expected no regressions, got", n)
+	}
+
+	atomic.StoreInt32(&broken, 1)
+	n, err = Replay(cfg, cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("expected 2 regressions, got", n)
+	}
+
+	out := stdout.String()
+	if !strings.Contains(out, "GET /status: status 200 → 500") {
+		t.Errorf("expected status regression in output:\n%s", out)
+	}
+	if !strings.Contains(out, "+ line two") {
+		t.Errorf("expected body diff in output:\n%s", out)
+	}
+
+	n, err = Replay(cfg, cfg.Record, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("expected 1 regression replaying the last request, got", n)
+	}
+}
+
+func TestRecordSkipsFaults(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Record = filepath.Join(dir, "tulpa.rec")
+	fault, err := ParseFault("error:100:/flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Faults = []*Fault{fault}
+
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	for _, p := range []string{"/ok", "/flaky"} {
+		res, err := http.Get(fmt.Sprintf("http://%s%s", s.Addr(), p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	exs, err := readRecording(cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 1 || exs[0].URL != "/ok" {
+		t.Fatalf("expected only /ok to be recorded, got %d exchanges", len(exs))
+	}
+	n, err := Replay(cfg, cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("expected no regressions, got", n)
+	}
+}
+
+func TestRecordReplayBinary(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Record = filepath.Join(dir, "tulpa.rec")
+
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintf(w, "%x", sha256.Sum256(b))
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	// Bodies past the inspector's limit are replayed whole.
+	big := strings.Repeat("cool ", inspectBodyLimit)
+	for contentType, body := range map[string][]byte{
+		"application/octet-stream": {0, 1, 2, 0xff, 0xfe},
+		"text/plain":               []byte(big),
+	} {
+		res, err := http.Post(fmt.Sprintf("http://%s/upload", s.Addr()), contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	n, err := Replay(cfg, cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("expected no regressions replaying binary and big bodies, got", n)
+	}
+
+	ex := (&exchange{ReqBody: big}).inspected()
+	if len(ex.ReqBody) != inspectBodyLimit || !ex.ReqTruncated {
+		t.Fatal("expected the inspector's copy of the request body to be truncated")
+	}
+}
+
+func TestReplayProxyHeaders(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Record = filepath.Join(dir, "tulpa.rec")
+	cfg.AuthUser = "cool-user"
+	cfg.AuthHeader = "X-Forwarded-User"
+	cfg.Rewrites = []*Rewrite{{RequestHeader: HeaderRewrite{Set: map[string]string{"X-Rewritten": "yes"}}}}
+
+	// The app depends on headers the proxy adds.
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range []string{"X-Forwarded-User", "X-Forwarded-Host", "X-Forwarded-For", "Forwarded", "X-Rewritten"} {
+			if r.Header.Get(k) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "missing %s", k)
+				return
+			}
+		}
+		fmt.Fprint(w, "ok")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("expected 200, got", res.StatusCode)
+	}
+
+	n, err := Replay(cfg, cfg.Record, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("expected no regressions, got", n)
+	}
+}
+
+func TestRecordingTail(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tulpa.rec")
+
+	rec, err := newRecording(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Escaping makes each line much longer than the bodies.
+	big := strings.Repeat("<&>", inspectBodyLimit/3)
+	for i, app := range []string{"a", "a", "b", "a"} {
+		rec.add(&exchange{ID: int64(i), App: app, ReqBody: big, ResBody: big})
+	}
+
+	check := func(rec *recording) {
+		t.Helper()
+		exs := rec.last("a")
+		if len(exs) != 2 || exs[0].ID != 1 || exs[1].ID != 3 {
+			t.Fatalf("expected the last 2 exchanges of a, got %d", len(exs))
+		}
+		if exs := rec.last("b"); len(exs) != 1 {
+			t.Fatalf("expected 1 exchange of b, got %d", len(exs))
+		}
+	}
+	check(rec)
+
+	exs, err := readRecording(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 4 || exs[3].ResBody != big {
+		t.Fatalf("expected 4 exchanges, got %d", len(exs))
+	}
+
+	// A new run picks up where the last one left off.
+	rec, err = newRecording(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rec)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Rewrite changes matching requests on their way to the app, and their
+// responses on the way back. Every matching rewrite is applied, in order.
+type Rewrite struct {
+	Match
+	RequestHeader  HeaderRewrite `json:"request_header"`
+	ResponseHeader HeaderRewrite `json:"response_header"`
+	// Host replaces the Host header sent to the app.
+	Host string `json:"host"`
+	// Location rewrites redirects to the app's address, or to Host, so they
+	// point at the proxy instead.
+	Location bool `json:"location"`
+	// CookieDomain replaces the Domain of cookies set by the app. An empty
+	// string removes it, so cookies are set for the proxy's host.
+	CookieDomain *string `json:"cookie_domain"`
+}
+
+// HeaderRewrite removes, then sets, then adds headers.
+type HeaderRewrite struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+func (hr *HeaderRewrite) apply(h http.Header) {
+	for _, k := range hr.Remove {
+		h.Del(k)
+	}
+	for k, v := range hr.Set {
+		h.Set(k, v)
+	}
+	for k, v := range hr.Add {
+		h.Add(k, v)
+	}
+}
+
+// rewriteKey is the context key of a request's rewriteContext.
+type rewriteKey struct{}
+
+// rewriteContext carries what the reverse proxy's hooks need to know about
+// the request as the client sent it.
+type rewriteContext struct {
+	rewrites []*Rewrite
+	host     string
+}
+
+func matchRewrites(rewrites []*Rewrite, r *http.Request) []*Rewrite {
+	var matched []*Rewrite
+	for _, rw := range rewrites {
+		if rw.matches(r) {
+			matched = append(matched, rw)
+		}
+	}
+	return matched
+}
+
+// withRewrites returns the request with its matching rewrites in its context.
+func withRewrites(rewrites []*Rewrite, r *http.Request) *http.Request {
+	rc := &rewriteContext{rewrites: matchRewrites(rewrites, r), host: r.Host}
+	return r.WithContext(context.WithValue(r.Context(), rewriteKey{}, rc))
+}
+
+func getRewrites(r *http.Request) *rewriteContext {
+	rc, _ := r.Context().Value(rewriteKey{}).(*rewriteContext)
+	if rc == nil {
+		return &rewriteContext{host: r.Host}
+	}
+	return rc
+}
+
+// director wraps the reverse proxy's director to set forwarded, auth and
+// trace headers, and apply request rewrites.
+func (a *app) director(next func(*http.Request)) func(*http.Request) {
+	return func(r *http.Request) {
+		next(r)
+		rc := getRewrites(r)
+		setForwarded(r, rc.host)
+		setAuthUser(r, a.cfg)
+		setTraceparent(r)
+		for _, rw := range rc.rewrites {
+			rw.RequestHeader.apply(r.Header)
+			if rw.Host != "" {
+				r.Host = rw.Host
+			}
+		}
+	}
+}
+
+// modifyResponse applies response rewrites and CORS headers.
+func (a *app) modifyResponse(res *http.Response) error {
+	rc := getRewrites(res.Request)
+	for _, rw := range rc.rewrites {
+		rw.ResponseHeader.apply(res.Header)
+		if rw.Location {
+			a.rewriteLocation(res.Header, rw.Host, rc.host)
+		}
+		if rw.CookieDomain != nil {
+			rewriteCookieDomains(res.Header, *rw.CookieDomain)
+		}
+	}
+	if a.cfg.CORS {
+		setCORSHeaders(res.Request, res.Header)
+	}
+	return nil
+}
+
+// rewriteLocation points absolute redirects to the app's address, or to
+// host, at the proxy.
+func (a *app) rewriteLocation(h http.Header, host, proxyHost string) {
+	loc := h.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || !u.IsAbs() {
+		return
+	}
+	if u.Host != a.up.url.Host && (host == "" || u.Host != host) {
+		return
+	}
+
+	u.Scheme = "http"
+	u.Host = proxyHost
+	h.Set("Location", u.String())
+}
+
+// rewriteCookieDomains replaces the Domain attribute of each Set-Cookie
+// header, or removes it if domain is empty.
+func rewriteCookieDomains(h http.Header, domain string) {
+	cookies := h["Set-Cookie"]
+	for i, c := range cookies {
+		parts := strings.Split(c, ";")
+		kept := parts[:1]
+		for _, attr := range parts[1:] {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr)), "domain=") {
+				continue
+			}
+			kept = append(kept, attr)
+		}
+		if domain != "" {
+			kept = append(kept, " Domain="+domain)
+		}
+		cookies[i] = strings.Join(kept, ";")
+	}
+}
+
+// isPreflight returns true if the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflight allows whatever the preflight request asks for.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	setCORSHeaders(r, h)
+	h.Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+	if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSHeaders allows the request's origin, with credentials.
+func setCORSHeaders(r *http.Request, h http.Header) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Credentials", "true")
+	h.Add("Vary", "Origin")
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRewriteCookieDomains(t *testing.T) {
+	tcs := []struct {
+		cookie string
+		domain string
+		want   string
+	}{
+		{cookie: "a=1; Domain=example.com; Path=/", domain: "", want: "a=1; Path=/"},
+		{cookie: "a=1; domain=.example.com", domain: "localhost", want: "a=1; Domain=localhost"},
+		{cookie: "a=1", domain: "localhost", want: "a=1; Domain=localhost"},
+	}
+
+	for _, tc := range tcs {
+		h := http.Header{"Set-Cookie": {tc.cookie}}
+		rewriteCookieDomains(h, tc.domain)
+		if got := h.Get("Set-Cookie"); got != tc.want {
+			t.Errorf("%q with domain %q: expected %q, got %q", tc.cookie, tc.domain, tc.want, got)
+		}
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	noDomain := ""
+	cfg := newTestConfig()
+	cfg.CORS = true
+	cfg.Rewrites = []*Rewrite{
+		{
+			Match: Match{Path: "/api/**"},
+			RequestHeader: HeaderRewrite{
+				Remove: []string{"X-Remove"},
+				Set:    map[string]string{"X-Env": "dev"},
+			},
+			ResponseHeader: HeaderRewrite{Set: map[string]string{"X-Served-By": "tulpa"}},
+			Host:           "api.example.com",
+			Location:       true,
+			CookieDomain:   &noDomain,
+		},
+	}
+	for _, rw := range cfg.Rewrites {
+		if err := rw.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Remove") != "" || r.Header.Get("X-Env") != "dev" || r.Host != "api.example.com" {
+			w.WriteHeader(400)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Domain: "api.example.com"})
+		http.Redirect(w, r, "http://api.example.com/api/login?next=%2F", http.StatusFound)
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/api/users", s.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Remove", "1")
+	req.Header.Set("Origin", "http://localhost:8080")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatal("expected request rewrites to be applied, got status", res.StatusCode)
+	}
+	if loc, want := res.Header.Get("Location"), fmt.Sprintf("http://%s/api/login?next=%%2F", req.Host); loc != want {
+		t.Fatalf("expected location %q, got %q", want, loc)
+	}
+	if c := res.Header.Get("Set-Cookie"); c != "session=1" {
+		t.Fatalf("expected cookie domain to be removed, got %q", c)
+	}
+	if res.Header.Get("X-Served-By") != "tulpa" {
+		t.Fatal("expected response header to be set")
+	}
+	if res.Header.Get("Access-Control-Allow-Origin") != "http://localhost:8080" {
+		t.Fatal("expected cors headers, got", res.Header)
+	}
+
+	req, err = http.NewRequest("OPTIONS", fmt.Sprintf("http://%s/api/users", s.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	req.Header.Set("Access-Control-Request-Headers", "X-Token")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal("expected preflight to get 204, got", res.StatusCode)
+	}
+	if res.Header.Get("Access-Control-Allow-Methods") != "DELETE" || res.Header.Get("Access-Control-Allow-Headers") != "X-Token" {
+		t.Fatal("expected preflight to allow the requested method and headers, got", res.Header)
+	}
+}
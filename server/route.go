@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Route sends requests matching a host and path prefix to an upstream. If the
+// route has a command, tulpa manages its process, restarting it when files in
+// the route's watch directories change.
+type Route struct {
+	// Name identifies the route in logs, metrics and hash cache files. Routes
+	// with a command need a unique one.
+	Name string `json:"name"`
+	// Host is matched against the request host, without the port. A leading
+	// "*." matches any subdomain.
+	Host string `json:"host"`
+	// Path is a path prefix, such as /api or /api/*. The longest matching
+	// prefix wins.
+	Path string `json:"path"`
+	// StripPrefix removes the matched path prefix before proxying.
+	StripPrefix bool   `json:"strip_prefix"`
+	Upstream    string `json:"upstream"`
+	// Port is the port of the upstream when Upstream isn't set. A free port is
+	// picked when it is 0.
+	Port    int      `json:"port"`
+	Command []string `json:"command"`
+	// Cwd is the working directory of the command.
+	Cwd string `json:"cwd"`
+	// Go is the main package of a Go command, to only restart it for changes
+	// to the files it's built from.
+	Go     string   `json:"go"`
+	Watch  []string `json:"watch"`
+	Ignore []string `json:"ignore"`
+	Wait   bool     `json:"wait"`
+	// Restart is the command's restart policy, like Config.Restart.
+	Restart string `json:"restart"`
+	// EnvFiles and Env are added to the command's environment, after the
+	// ones from the command line.
+	EnvFiles []string `json:"env_files"`
+	Env      []string `json:"env"`
+	ClearEnv bool     `json:"clear_env"`
+}
+
+func (rt *Route) String() string {
+	return rt.Host + rt.prefix() + "*"
+}
+
+func (rt *Route) prefix() string {
+	p := strings.TrimSuffix(rt.Path, "*")
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// score returns how specific a route is. Host routes are preferred over
+// path-only routes, and longer prefixes over shorter ones.
+func (rt *Route) score() int {
+	n := len(rt.prefix())
+	if rt.Host != "" {
+		n += 1 << 16
+	}
+	return n
+}
+
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Host != "" && !matchHost(rt.Host, r.Host) {
+		return false
+	}
+
+	p := rt.prefix()
+	if p == "/" {
+		return true
+	}
+	dir := strings.TrimSuffix(p, "/")
+	return r.URL.Path == dir || strings.HasPrefix(r.URL.Path, dir+"/")
+}
+
+// strip removes the route's path prefix from the request path.
+func (rt *Route) strip(r *http.Request) {
+	if !rt.StripPrefix {
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(rt.prefix(), "/"))
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	r.URL.Path = p
+	r.URL.RawPath = ""
+}
+
+func matchHost(pattern, hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
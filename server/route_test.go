@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouteMatch(t *testing.T) {
+	tcs := []struct {
+		route *Route
+		host  string
+		path  string
+		match bool
+	}{
+		{route: &Route{}, host: "localhost:4000", path: "/", match: true},
+		{route: &Route{Path: "/api/*"}, host: "localhost:4000", path: "/api/users", match: true},
+		{route: &Route{Path: "/api/*"}, host: "localhost:4000", path: "/api", match: true},
+		{route: &Route{Path: "/api"}, host: "localhost:4000", path: "/apis", match: false},
+		{route: &Route{Host: "admin.localhost"}, host: "admin.localhost:4000", path: "/", match: true},
+		{route: &Route{Host: "admin.localhost"}, host: "localhost:4000", path: "/", match: false},
+		{route: &Route{Host: "*.localhost"}, host: "app.localhost", path: "/", match: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(fmt.Sprintf("%s%s", tc.host, tc.path), func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			r.Host = tc.host
+			if got := tc.route.matches(r); got != tc.match {
+				t.Fatalf("expected %s match=%t, got %t", tc.route, tc.match, got)
+			}
+		})
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	cfg := newTestConfig()
+
+	web := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "web ", r.URL.Path)
+	})
+	defer web.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "api ", r.URL.Path)
+	}))
+	defer api.Close()
+
+	cfg.Routes = []*Route{
+		{Name: "api", Path: "/api/*", StripPrefix: true, Upstream: api.URL, Command: []string{"cool"}},
+	}
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	tcs := []struct {
+		path string
+		body string
+	}{
+		{path: "/", body: "web /"},
+		{path: "/api/users", body: "api /users"},
+		{path: "/apis", body: "web /apis"},
+	}
+	for _, tc := range tcs {
+		res, err := http.Get(fmt.Sprintf("http://%s%s", s.Addr(), tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != tc.body {
+			t.Errorf("%s: expected %q, got %q", tc.path, tc.body, string(b))
+		}
+	}
+}
+
+func TestForRoute(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Cwd = "/src"
+	cfg.Go = "./cmd/api"
+	cfg.Watch = []string{"cmd"}
+	cfg.Static = "dist"
+	cfg.Restart = RestartAlways
+	cfg.Wait = true
+	cfg.HashCache = ".tulpa-hashes"
+	cfg.Env = []string{"A=1"}
+
+	rc, err := cfg.forRoute(&Route{Name: "web", Port: 5173, Command: []string{"npm", "run", "dev"}, Watch: []string{"web"}, Env: []string{"B=2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Cwd != "" || rc.Go != "" || rc.Static != "" || rc.Restart != "" {
+		t.Fatalf("expected the default app's settings to be reset, got cwd=%q go=%q static=%q restart=%q", rc.Cwd, rc.Go, rc.Static, rc.Restart)
+	}
+	if !reflect.DeepEqual(rc.Watch, []string{"web"}) || rc.AppPort != 5173 {
+		t.Fatalf("expected the route's settings, got watch=%v port=%d", rc.Watch, rc.AppPort)
+	}
+	if !rc.Wait || rc.HashCache != ".tulpa-hashes.web" || !reflect.DeepEqual(rc.Env, []string{"A=1", "B=2"}) {
+		t.Fatalf("expected shared settings, got wait=%t hash cache=%q env=%v", rc.Wait, rc.HashCache, rc.Env)
+	}
+
+	if _, err := cfg.forRoute(&Route{Name: "web", Restart: "sometimes"}); err == nil {
+		t.Fatal("expected error for invalid restart policy")
+	}
+}
+
+func TestRouteSockets(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Upstream = "unix://"
+	cfg.Routes = []*Route{
+		{Name: "api", Path: "/api", Upstream: "unix://", Command: []string{"cool"}},
+		{Name: "web/app", Path: "/web", Upstream: "unix://", Command: []string{"cool"}},
+	}
+	s, err := New(cfg, []string{"cool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range s.apps {
+		sock := a.up.socket
+		if sock == "" || seen[sock] || filepath.Dir(sock) != os.TempDir() {
+			t.Fatalf("expected a socket of its own in the temp dir for %q, got %q", a.route.Name, sock)
+		}
+		seen[sock] = true
+	}
+}
+
+func TestRouteNames(t *testing.T) {
+	for _, routes := range [][]*Route{
+		{{Path: "/api", Command: []string{"cool"}}},
+		{{Name: "api", Path: "/api", Command: []string{"cool"}}, {Name: "api", Path: "/v2", Command: []string{"cool"}}},
+	} {
+		cfg := newTestConfig()
+		cfg.Routes = routes
+		if _, err := New(cfg, nil); err == nil || !strings.Contains(err.Error(), "unique name") {
+			t.Fatalf("expected name error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	distFixed       = "fixed"
+	distUniform     = "uniform"
+	distNormal      = "normal"
+	distPercentiles = "percentiles"
+)
+
+// Rule sets the latency and error rate of matching requests. The first
+// matching rule is used, and it replaces --latency for the request.
+type Rule struct {
+	Match
+	Latency *Distribution `json:"latency"`
+	// ErrorRate is the percentage of requests that get one of Statuses
+	// (default 500) instead of the app's response.
+	ErrorRate float64 `json:"error_rate"`
+	Statuses  []int   `json:"statuses"`
+}
+
+func (rule *Rule) compile() error {
+	if rule.Latency != nil {
+		if err := rule.Latency.validate(); err != nil {
+			return err
+		}
+	}
+	return rule.Match.compile()
+}
+
+// fault returns an error fault if the rule's error rate fires.
+func (rule *Rule) fault() *Fault {
+	if rule.ErrorRate <= 0 || rand.Float64()*100 >= rule.ErrorRate {
+		return nil
+	}
+
+	status := http.StatusInternalServerError
+	if len(rule.Statuses) > 0 {
+		status = rule.Statuses[rand.Intn(len(rule.Statuses))]
+	}
+	return &Fault{Kind: faultError, Status: status}
+}
+
+func matchRule(rules []*Rule, r *http.Request) *Rule {
+	for _, rule := range rules {
+		if rule.matches(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Distribution is a latency distribution. Kind is one of:
+//
+//	fixed        always Value
+//	uniform      between Min and Max
+//	normal       around Mean, with StdDev
+//	percentiles  follows Percentiles, like {"p50": "100ms", "p99": "2s"}
+//
+// Kind may be left out, in which case it's guessed from the fields that are
+// set. A plain duration string, like "200ms", is a fixed distribution.
+type Distribution struct {
+	Kind        string              `json:"kind"`
+	Value       Duration            `json:"value"`
+	Min         Duration            `json:"min"`
+	Max         Duration            `json:"max"`
+	Mean        Duration            `json:"mean"`
+	StdDev      Duration            `json:"stddev"`
+	Percentiles map[string]Duration `json:"percentiles"`
+	points      []percentilePoint
+}
+
+type percentilePoint struct {
+	q float64
+	d time.Duration
+}
+
+func (d *Distribution) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Distribution{Kind: distFixed, Value: Duration(parsed)}
+		return nil
+	}
+
+	type distribution Distribution
+	var dist distribution
+	if err := json.Unmarshal(b, &dist); err != nil {
+		return err
+	}
+	*d = Distribution(dist)
+	return nil
+}
+
+func (d *Distribution) validate() error {
+	if d.Kind == "" {
+		switch {
+		case len(d.Percentiles) > 0:
+			d.Kind = distPercentiles
+		case d.Mean > 0 || d.StdDev > 0:
+			d.Kind = distNormal
+		case d.Max > 0:
+			d.Kind = distUniform
+		default:
+			d.Kind = distFixed
+		}
+	}
+
+	switch d.Kind {
+	case distFixed, distNormal:
+	case distUniform:
+		if d.Max < d.Min {
+			return fmt.Errorf("uniform latency: max %s is less than min %s", time.Duration(d.Max), time.Duration(d.Min))
+		}
+	case distPercentiles:
+		return d.parsePercentiles()
+	default:
+		return fmt.Errorf("unknown latency distribution %q", d.Kind)
+	}
+	return nil
+}
+
+// parsePercentiles turns Percentiles into points of the inverse cumulative
+// distribution, starting at 0.
+func (d *Distribution) parsePercentiles() error {
+	d.points = []percentilePoint{{q: 0, d: 0}}
+	for k, v := range d.Percentiles {
+		q, err := strconv.ParseFloat(strings.TrimPrefix(strings.ToLower(k), "p"), 64)
+		if err != nil || q < 0 || q > 100 {
+			return fmt.Errorf("invalid percentile %q", k)
+		}
+		d.points = append(d.points, percentilePoint{q: q / 100, d: time.Duration(v)})
+	}
+
+	sort.Slice(d.points, func(i, j int) bool { return d.points[i].q < d.points[j].q })
+	for i := 1; i < len(d.points); i++ {
+		if d.points[i].d < d.points[i-1].d {
+			return fmt.Errorf("percentile latencies must increase, but p%g is %s", d.points[i].q*100, d.points[i].d)
+		}
+	}
+	return nil
+}
+
+// sample returns a random latency from the distribution.
+func (d *Distribution) sample() time.Duration {
+	var dur time.Duration
+	switch d.Kind {
+	case distUniform:
+		dur = time.Duration(d.Min)
+		if span := int64(d.Max - d.Min); span > 0 {
+			dur += time.Duration(rand.Int63n(span))
+		}
+	case distNormal:
+		dur = time.Duration(d.Mean) + time.Duration(rand.NormFloat64()*float64(d.StdDev))
+	case distPercentiles:
+		dur = d.samplePercentiles(rand.Float64())
+	default:
+		dur = time.Duration(d.Value)
+	}
+
+	if dur < 0 {
+		return 0
+	}
+	return dur
+}
+
+// samplePercentiles interpolates the latency at quantile q between the
+// surrounding percentiles. Quantiles past the last percentile get its
+// latency.
+func (d *Distribution) samplePercentiles(q float64) time.Duration {
+	for i := 1; i < len(d.points); i++ {
+		lo, hi := d.points[i-1], d.points[i]
+		if q > hi.q {
+			continue
+		}
+		if hi.q == lo.q {
+			return hi.d
+		}
+		frac := (q - lo.q) / (hi.q - lo.q)
+		return lo.d + time.Duration(frac*float64(hi.d-lo.d))
+	}
+	return d.points[len(d.points)-1].d
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDistribution(t *testing.T) {
+	tcs := []struct {
+		json string
+		min  time.Duration
+		max  time.Duration
+	}{
+		{json: `"150ms"`, min: 150 * time.Millisecond, max: 150 * time.Millisecond},
+		{json: `{"min": "10ms", "max": "20ms"}`, min: 10 * time.Millisecond, max: 20 * time.Millisecond},
+		{json: `{"kind": "normal", "mean": "100ms", "stddev": "0s"}`, min: 100 * time.Millisecond, max: 100 * time.Millisecond},
+		{json: `{"percentiles": {"p50": "100ms", "p99": "1s"}}`, min: 0, max: time.Second},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.json, func(t *testing.T) {
+			d := &Distribution{}
+			if err := json.Unmarshal([]byte(tc.json), d); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 100; i++ {
+				if got := d.sample(); got < tc.min || got > tc.max {
+					t.Fatalf("expected sample between %s and %s, got %s", tc.min, tc.max, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDistributionPercentiles(t *testing.T) {
+	d := &Distribution{Percentiles: map[string]Duration{
+		"p50": Duration(100 * time.Millisecond),
+		"p75": Duration(500 * time.Millisecond),
+	}}
+	if err := d.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{q: 0.25, want: 50 * time.Millisecond},
+		{q: 0.5, want: 100 * time.Millisecond},
+		{q: 0.625, want: 300 * time.Millisecond},
+		{q: 0.95, want: 500 * time.Millisecond},
+	}
+	for _, tc := range tcs {
+		if got := d.samplePercentiles(tc.q); got != tc.want {
+			t.Errorf("q=%g: expected %s, got %s", tc.q, tc.want, got)
+		}
+	}
+
+	d = &Distribution{Percentiles: map[string]Duration{"p50": Duration(time.Second), "p90": Duration(time.Millisecond)}}
+	if err := d.validate(); err == nil {
+		t.Fatal("expected error for decreasing percentiles")
+	}
+}
+
+func TestRules(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfgPath := filepath.Join(dir, "tulpa.json")
+	err := ioutil.WriteFile(cfgPath, []byte(`{
+		"rules": [
+			{"path": "/api/search", "latency": "100ms"},
+			{"method": "POST", "path": "/api/**", "error_rate": 100, "statuses": [503]}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig()
+	if err := cfg.Load(cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	start := time.Now()
+	res, err := http.Get(fmt.Sprintf("http://%s/api/search", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("expected /api/search to take at least 100ms, took %s", took)
+	}
+
+	start = time.Now()
+	res, err = http.Get(fmt.Sprintf("http://%s/other", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if took := time.Since(start); took >= 100*time.Millisecond {
+		t.Fatalf("expected /other to be fast, took %s", took)
+	}
+
+	res, err = http.Post(fmt.Sprintf("http://%s/api/users", s.Addr()), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 503 {
+		t.Fatal("expected 503, got", res.StatusCode)
+	}
+}
@@ -4,47 +4,115 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+)
+
+// Restart policies of the command when it exits on its own.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	// restartBackoffMax is the longest wait before restarting a crashed
+	// command.
+	restartBackoffMax = 30 * time.Second
+	// crashResetAfter is how long the command has to stay up for its crashes
+	// to stop counting towards a crash loop.
+	crashResetAfter = 10 * time.Second
 )
 
 type runner struct {
 	cfg    *Config
 	args   []string
 	errors chan error
-	cmd    *exec.Cmd
-	pid    int
-	stderr *bytes.Buffer
-	env    []string // for testing
-	mu     sync.Mutex
-	stop   chan struct{}
+	// restarts receives the generation of a crashed command once its backoff
+	// is over.
+	restarts chan int64
+	cmd      *exec.Cmd
+	pid      int
+	stderr   *bytes.Buffer
+	env      []string // for testing
+	mu       sync.Mutex
+	stop     chan struct{}
+	// launchMu serializes launches, which can come from the server's loop
+	// after a crash and from the debouncer's timer after file changes at the
+	// same time. It guards pid, changed and runs.
+	launchMu sync.Mutex
+	// gen is incremented each time tulpa kills the command, so exits can be
+	// told apart from crashes.
+	gen int64
+	// crashes is the number of times in a row the command crashed.
+	crashes int32
+	// lastExit describes how the command last ended.
+	lastExit atomic.Value
+	// runs is the number of times run was called. The first run starts the
+	// command, and the rest restart it after file changes. Restarts after
+	// crashes don't count.
+	runs int
+	// changed are the files whose changes caused the current run.
+	changed []string
 }
 
 func newRunner(cfg *Config, args []string) *runner {
 	return &runner{
-		cfg:    cfg,
-		args:   args,
-		errors: make(chan error),
-		stop:   make(chan struct{}),
+		cfg:      cfg,
+		args:     args,
+		errors:   make(chan error),
+		restarts: make(chan int64),
+		stop:     make(chan struct{}),
 	}
 }
 
+// run restarts the command, and forgets about previous crashes.
 func (r *runner) run() error {
-	r.kill()
+	r.launchMu.Lock()
+	defer r.launchMu.Unlock()
+	atomic.StoreInt32(&r.crashes, 0)
+	r.runs++
+	return r.launch()
+}
+
+// restart restarts a crashed command, unless it has been restarted since. It
+// returns false if it wasn't.
+func (r *runner) restart(gen int64) (bool, error) {
+	r.launchMu.Lock()
+	defer r.launchMu.Unlock()
+	if atomic.LoadInt64(&r.gen) != gen {
+		return false, nil
+	}
+	r.changed = nil
+	return true, r.launch()
+}
+
+// launch starts the command, after killing the running one. It must be
+// called with launchMu held.
+func (r *runner) launch() error {
+	r.terminate()
 
 	if err := r.execute(); err != nil {
 		return err
 	}
 
+	cmd, stderr := r.cmd, r.stderr
+	gen := atomic.LoadInt64(&r.gen)
+	started := time.Now()
 	if r.cfg.Wait {
-		return r.wait()
+		return r.wait(cmd, stderr, gen, started)
 	} else {
 		go func() {
-			ignoreError(r.wait())
+			ignoreError(r.wait(cmd, stderr, gen, started))
 		}()
 	}
 
@@ -61,8 +129,22 @@ func (r *runner) execute() error {
 	r.stderr = &bytes.Buffer{}
 	mw := io.MultiWriter(r.stderr, os.Stderr)
 
-	r.cmd = execCommand(context.TODO(), "/bin/sh", "-c", strings.Join(r.args, " "))
-	r.cmd.Env = append(r.cmd.Env, r.env...)
+	up, err := r.cfg.upstream()
+	if err != nil {
+		return err
+	}
+	if err := up.removeSocket(); err != nil {
+		return err
+	}
+
+	name, args := r.command()
+	r.cmd = execCommand(context.TODO(), name, args...)
+	env, err := r.environ(up)
+	if err != nil {
+		return err
+	}
+	r.cmd.Env = env
+	r.cmd.Dir = r.cfg.Cwd
 	r.cmd.Stdout = os.Stdout
 	r.cmd.Stderr = mw
 
@@ -71,16 +153,87 @@ func (r *runner) execute() error {
 	r.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	if err := r.cmd.Start(); err != nil {
-		return errors.New(r.stderr.String())
+		return err
 	}
 	r.pid = r.cmd.Process.Pid
 	return nil
 }
 
-// Wait for the command to finish. If the process exits with an error, only log
-// it if it exit status is postive, as status code -1 is returned when the
-// process was killed by runner#kill.
-func (r *runner) wait() error {
+// defaultShell runs commands unless another shell is configured.
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// command returns the program to run and its arguments. Commands are run by
+// a shell, so they can use pipes, &&, and so on, unless NoShell is set, in
+// which case the args are run as they are.
+func (r *runner) command() (string, []string) {
+	if r.cfg.NoShell {
+		return r.args[0], r.args[1:]
+	}
+	shell := strings.Fields(r.cfg.Shell)
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	args := append(append([]string(nil), shell[1:]...), strings.Join(r.args, " "))
+	return shell[0], args
+}
+
+// environ returns the environment the command is run with: tulpa's own
+// environment, or only its PATH with ClearEnv, then the env files and --env
+// vars, tulpa's vars, and the address of the upstream the command should
+// listen on. Later values override earlier ones.
+func (r *runner) environ(up *upstream) ([]string, error) {
+	env := r.cmd.Env
+	if env == nil {
+		if r.cfg.ClearEnv {
+			if path, ok := os.LookupEnv("PATH"); ok {
+				env = []string{"PATH=" + path}
+			}
+		} else {
+			env = os.Environ()
+		}
+	}
+
+	fileEnv, err := readEnvFiles(r.cfg.EnvFiles)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, fileEnv...)
+	env = append(env, expandEnv(r.cfg.Env)...)
+	env = append(env,
+		"TULPA=1",
+		"TULPA_RESTART_COUNT="+strconv.Itoa(r.restartCount()),
+		"TULPA_CHANGED_FILES="+strings.Join(r.changed, string(os.PathListSeparator)),
+	)
+
+	if up.socket != "" && r.cfg.SocketEnv != "" {
+		env = append(env, r.cfg.SocketEnv+"="+up.socket)
+	}
+	if port := up.port(); port > 0 && r.cfg.PortEnv != "" {
+		env = append(env, r.cfg.PortEnv+"="+strconv.Itoa(port))
+	}
+	return append(env, r.env...), nil
+}
+
+// restartCount returns the number of times the command was restarted after
+// file changes.
+func (r *runner) restartCount() int {
+	if r.runs <= 1 {
+		return 0
+	}
+	return r.runs - 1
+}
+
+// setChanged sets the files whose changes caused the next run.
+func (r *runner) setChanged(files []string) {
+	r.launchMu.Lock()
+	defer r.launchMu.Unlock()
+	r.changed = files
+}
+
+// Wait for the command to finish, and report how it ended. Exits caused by
+// runner#kill are expected, others put the proxy in an error state, unless the
+// restart policy restarts the command.
+func (r *runner) wait(cmd *exec.Cmd, stderr *bytes.Buffer, gen int64, started time.Time) error {
 	select {
 	case <-r.stop:
 		return nil
@@ -88,34 +241,137 @@ func (r *runner) wait() error {
 	}
 
 	r.mu.Lock()
-	err := r.cmd.Wait()
+	err := cmd.Wait()
 	r.mu.Unlock()
 
-	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			ws := exiterr.Sys().(syscall.WaitStatus)
-			if ws.ExitStatus() > 0 {
-				errStr := r.stderr.String()
-				if errStr == "" {
-					errStr = "non-zero exit (but no output) from subprocess"
-				}
-				err = errors.New(errStr)
-
-				if r.cfg.Wait {
-					return err
-				} else {
-					r.errors <- err
-				}
-			}
+	if cmd.ProcessState == nil {
+		return err
+	}
+	st := newExitStatus(cmd.ProcessState, time.Since(started))
+	r.lastExit.Store(st.String())
+
+	if atomic.LoadInt64(&r.gen) != gen {
+		r.cfg.Debugf("app stopped, %s", st)
+		return nil
+	}
+
+	if r.cfg.Wait {
+		if st.success() {
+			r.cfg.Debugf("command %s", st)
+			return nil
+		}
+		r.cfg.Printf("command %s", st)
+		if st.signal != 0 {
+			return st.error("command", stderr)
 		}
+		return stderrError(stderr)
 	}
 
+	r.cfg.Printf("app %s", st)
+	if r.shouldRestart(st) {
+		r.crashed(st, stderr, gen)
+		return nil
+	}
+	select {
+	case r.errors <- st.error("app", stderr):
+	case <-r.stop:
+	}
 	return nil
 }
 
+func (r *runner) shouldRestart(st *exitStatus) bool {
+	switch r.cfg.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return !st.success()
+	}
+	return false
+}
+
+// crashed restarts the command after a backoff, or gives up with an error if
+// it keeps crashing. The restart is sent to the server, which calls restart.
+// It may still happen while a file change reruns the command, so restart
+// ignores it if the command has been killed since.
+func (r *runner) crashed(st *exitStatus, stderr *bytes.Buffer, gen int64) {
+	if st.runtime >= crashResetAfter {
+		atomic.StoreInt32(&r.crashes, 0)
+	}
+	n := int(atomic.AddInt32(&r.crashes, 1))
+	if max := r.cfg.RestartMax; max > 0 && n > max {
+		r.cfg.Printf("giving up after %d restarts", max)
+		select {
+		case r.errors <- fmt.Errorf("crash loop: gave up after %d restarts, not restarting until files change\n\n%s", max, st.error("app", stderr)):
+		case <-r.stop:
+		}
+		return
+	}
+
+	d := restartDelay(r.cfg.RestartBackoff, n)
+	if r.cfg.RestartMax > 0 {
+		r.cfg.Printf("restarting in %s (%d/%d)", d, n, r.cfg.RestartMax)
+	} else {
+		r.cfg.Printf("restarting in %s", d)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.stop:
+		return
+	}
+	if atomic.LoadInt64(&r.gen) != gen {
+		return
+	}
+	select {
+	case r.restarts <- gen:
+	case <-r.stop:
+	}
+}
+
+// restartDelay returns the backoff before the nth restart: base doubled for
+// each previous restart, with up to half of it taken off at random so apps
+// crashing together don't restart together.
+func restartDelay(base time.Duration, n int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < n && d < restartBackoffMax; i++ {
+		d *= 2
+	}
+	if d > restartBackoffMax {
+		d = restartBackoffMax
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func stderrError(stderr *bytes.Buffer) error {
+	errStr := stderr.String()
+	if errStr == "" {
+		errStr = "non-zero exit (but no output) from subprocess"
+	}
+	return errors.New(errStr)
+}
+
+// lastExitStatus returns how the command last ended, or "" if it hasn't.
+func (r *runner) lastExitStatus() string {
+	s, _ := r.lastExit.Load().(string)
+	return s
+}
+
 // Kill the existing process & process group
 func (r *runner) kill() {
+	r.launchMu.Lock()
+	defer r.launchMu.Unlock()
+	r.terminate()
+}
+
+// terminate kills the command. It must be called with launchMu held.
+func (r *runner) terminate() {
 	if r.pid > 0 {
+		atomic.AddInt64(&r.gen, 1)
 		if pgid, err := syscall.Getpgid(r.pid); err == nil {
 			ignoreError(syscall.Kill(-pgid, syscall.SIGKILL))
 		}
@@ -126,5 +382,11 @@ func (r *runner) kill() {
 		r.mu.Lock()
 		r.cmd = nil
 		r.mu.Unlock()
+
+		if up, err := r.cfg.upstream(); err == nil {
+			if err := up.removeSocket(); err != nil {
+				r.cfg.Printf("socket: %v", err)
+			}
+		}
 	}
 }
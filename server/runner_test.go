@@ -1,8 +1,12 @@
 package server
 
 import (
+	"fmt"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRunner(t *testing.T) {
@@ -45,6 +49,283 @@ func TestRunnerFail(t *testing.T) {
 	}
 }
 
+func TestRunnerSocketEnv(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	cfg.Wait = true
+	cfg.Upstream = "unix:///tmp/tulpa-test.sock"
+	cfg.SocketEnv = "SOCKET"
+	runner := newRunner(cfg, []string{"cool"})
+	runner.env = []string{"_FAKEPROC_EXPECT_ENV=SOCKET=/tmp/tulpa-test.sock"}
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerPortEnv(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	cfg.Wait = true
+	cfg.AppPort = 3456
+	cfg.PortEnv = "PORT"
+	runner := newRunner(cfg, []string{"cool"})
+	runner.env = []string{"_FAKEPROC_EXPECT_ENV=PORT=3456"}
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerRestartCount(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg := newTestConfig()
+	cfg.Wait = true
+	runner := newRunner(cfg, []string{"cool"})
+	for i := 0; i < 2; i++ {
+		runner.env = []string{fmt.Sprintf("_FAKEPROC_EXPECT_ENV=TULPA_RESTART_COUNT=%d", i)}
+		if err := runner.run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restarts after crashes don't count.
+	if _, err := runner.restart(atomic.LoadInt64(&runner.gen)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpstreamPort(t *testing.T) {
+	for upstream, want := range map[string]int{
+		"http://localhost:3456":    3456,
+		"http://localhost":         80,
+		"https://127.0.0.1":        443,
+		"http://example.com":       0,
+		"https://example.com:8443": 0,
+		"unix:///tmp/tulpa.sock":   0,
+	} {
+		up, err := parseUpstream(upstream, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port := up.port(); port != want {
+			t.Errorf("%s: expected port %d, got %d", upstream, want, port)
+		}
+	}
+}
+
+func TestRunnerShell(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	tcs := []struct {
+		name    string
+		shell   string
+		noShell bool
+		want    string
+	}{
+		{name: "default", want: `/bin/sh -c "echo a b"`},
+		{name: "shell", shell: "bash -lc", want: `bash -lc "echo a b"`},
+		{name: "no shell", noShell: true, want: `echo "a b"`},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.Wait = true
+			cfg.Shell = tc.shell
+			cfg.NoShell = tc.noShell
+			runner := newRunner(cfg, []string{"echo", "a b"})
+			runner.env = []string{"_FAKEPROC_EXPECT_ARG=" + tc.want}
+			if err := runner.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRunnerCwd(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig()
+	cfg.Wait = true
+	cfg.Cwd = dir
+	runner := newRunner(cfg, []string{"cool"})
+	runner.env = []string{"_FAKEPROC_EXPECT_CWD=" + dir}
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerRestartPolicy(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	tcs := []struct {
+		name    string
+		policy  string
+		code    string
+		restart bool
+	}{
+		{name: "never", policy: RestartNever, code: "1"},
+		{name: "on-failure", policy: RestartOnFailure, code: "1", restart: true},
+		{name: "on-failure clean exit", policy: RestartOnFailure, code: "0"},
+		{name: "always", policy: RestartAlways, code: "0", restart: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _, _ := newTestConfigOutErr()
+			cfg.Restart = tc.policy
+			cfg.RestartBackoff = time.Millisecond
+			runner := newRunner(cfg, []string{"cool"})
+			runner.env = []string{"_FAKEPROC_EXITCODE=" + tc.code}
+			defer close(runner.stop)
+			if err := runner.run(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Processes built with -race take a second to exit cleanly.
+			timeout := 500 * time.Millisecond
+			if tc.restart {
+				timeout = 3 * time.Second
+			}
+			select {
+			case <-runner.restarts:
+				if !tc.restart {
+					t.Fatal("expected no restart")
+				}
+			case err := <-runner.errors:
+				if tc.restart {
+					t.Fatal("expected restart, got error", err)
+				}
+			case <-time.After(timeout):
+				if tc.restart {
+					t.Fatal("timed out waiting for restart")
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerCrashLoop(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Restart = RestartOnFailure
+	cfg.RestartMax = 2
+	cfg.RestartBackoff = time.Millisecond
+	runner := newRunner(cfg, []string{"cool"})
+	runner.env = []string{"_FAKEPROC_EXITCODE=1", "_FAKEPROC_STDERR=cool error"}
+	defer close(runner.stop)
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarts := 0
+	for {
+		select {
+		case gen := <-runner.restarts:
+			restarts++
+			if _, err := runner.restart(gen); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		case err := <-runner.errors:
+			if restarts != 2 {
+				t.Fatalf("expected 2 restarts, got %d", restarts)
+			}
+			if !strings.HasPrefix(err.Error(), "crash loop:") || !strings.Contains(err.Error(), "cool error") {
+				t.Fatal("expected crash loop error, got", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for crash loop")
+		}
+		break
+	}
+
+	// A stale restart is ignored once the command has been rerun.
+	runner.env = []string{"_FAKEPROC_SLEEP=1s"}
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+	pid := runner.pid
+	restarted, err := runner.restart(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted || runner.pid != pid {
+		t.Fatal("expected stale restart to be ignored")
+	}
+	runner.kill()
+}
+
+func TestRunnerConcurrentRestarts(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Restart = RestartAlways
+	runner := newRunner(cfg, []string{"cool"})
+	defer runner.kill()
+	defer close(runner.stop)
+	if err := runner.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash restart and a restart after file changes at the same time.
+	for i := 0; i < 3; i++ {
+		var gen int64
+		select {
+		case gen = <-runner.restarts:
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for restart")
+		}
+
+		errc := make(chan error, 2)
+		go func() {
+			_, err := runner.restart(gen)
+			errc <- err
+		}()
+		go func() {
+			runner.setChanged([]string{"main.go"})
+			errc <- runner.run()
+		}()
+		for j := 0; j < 2; j++ {
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	for n, want := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 20: restartBackoffMax} {
+		for i := 0; i < 20; i++ {
+			d := restartDelay(100*time.Millisecond, n)
+			if d < want/2 || d > want {
+				t.Fatalf("restart %d: expected delay between %s and %s, got %s", n, want/2, want, d)
+			}
+		}
+	}
+	if d := restartDelay(0, 3); d != 0 {
+		t.Fatal("expected no delay, got", d)
+	}
+}
+
 // func setEnv(environ []string) func() {
 // 	var unsetEnv []string
 // 	oldEnv := make(map[string]string)
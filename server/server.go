@@ -2,24 +2,87 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"time"
 )
 
 type Server struct {
-	cfg     *Config
-	proxy   *proxy
-	runner  *runner
-	watcher *watcher
+	cfg    *Config
+	proxy  *proxy
+	apps   []*app
+	errors chan *appError
+	// restarts receives apps whose command crashed and is due a restart.
+	restarts chan *appRestart
 }
 
-func New(cfg *Config, args []string) *Server {
-	return &Server{
-		cfg:     cfg,
-		proxy:   newProxy(cfg),
-		runner:  newRunner(cfg, args),
-		watcher: newWatcher(cfg),
+// scanRequest asks the server to scan an app for changes, and restart it if
+// needed, before a request is proxied to it.
+type scanRequest struct {
+	app *app
+	// ctx carries the request's trace.
+	ctx context.Context
+}
+
+type appError struct {
+	app *app
+	err error
+}
+
+// changedSummaryMax is the number of changed files logged on restarts.
+const changedSummaryMax = 3
+
+type appRestart struct {
+	app *app
+	gen int64
+}
+
+// New returns a Server running args as the default app, and an app for each
+// of cfg.Routes. args may be empty if there are routes.
+func New(cfg *Config, args []string) (*Server, error) {
+	s := &Server{
+		cfg:      cfg,
+		errors:   make(chan *appError),
+		restarts: make(chan *appRestart),
+	}
+
+	if len(args) > 0 || len(cfg.Routes) == 0 {
+		a, err := newApp(cfg, &Route{Command: args})
+		if err != nil {
+			return nil, err
+		}
+		s.apps = append(s.apps, a)
 	}
+
+	names := make(map[string]bool)
+	for _, rt := range cfg.Routes {
+		if len(rt.Command) > 0 {
+			if rt.Name == "" || names[rt.Name] {
+				return nil, fmt.Errorf("route %s: routes with a command need a unique name", rt)
+			}
+			names[rt.Name] = true
+		}
+		rc, err := cfg.forRoute(rt)
+		if err != nil {
+			return nil, err
+		}
+		a, err := newApp(rc, rt)
+		if err != nil {
+			return nil, err
+		}
+		s.apps = append(s.apps, a)
+	}
+
+	p, err := newProxy(cfg, s.apps)
+	if err != nil {
+		return nil, err
+	}
+	s.proxy = p
+	s.proxy.admin = newAdminHandler(s)
+	return s, nil
 }
 
 func (s *Server) Addr() net.Addr { return s.proxy.ln.Addr() }
@@ -49,27 +112,71 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) start(stop chan error, ready chan error) error {
+	listening := make(chan error, 1)
 	go func() {
-		if err := s.proxy.start(ready); err != nil {
+		if err := s.proxy.start(listening); err != nil {
 			stop <- err
 		}
 	}()
 
-	if err := s.runner.run(); err != nil {
-		s.proxy.setError(err)
+	for _, a := range s.apps {
+		if !a.managed() {
+			continue
+		}
+		go s.forwardErrors(a)
+		// Loading the graph can take a while in big modules. All changes
+		// count until it's loaded.
+		go a.watcher.updateGoGraph()
+		a.watcher.prime()
+		a.watcher.start()
+
+		if err := a.runner.run(); err != nil {
+			s.proxy.metrics.buildFailed(a)
+			a.setError(err)
+		}
 	}
 
-	debounced := newDebouncer(s.cfg)
+	// Signal readiness once the proxy is listening and the apps have been
+	// started.
+	if ready != nil {
+		select {
+		case err := <-listening:
+			ready <- err
+		case err := <-stop:
+			ready <- err
+			s.Stop()
+			return err
+		}
+	}
 
 	for {
 		select {
-		case <-s.proxy.requests:
-			debounced(s.doScan)
-			s.proxy.unpause <- struct{}{}
+		case req := <-s.proxy.requests:
+			a := req.app
+			restarts := a.restartCount()
+			ctx, span := s.proxy.tracer.start(req.ctx, "debounce")
+			a.debounced(func() { s.doScan(ctx, a) })
+			span.finish()
+			var reloaded []string
+			if a.restartCount() != restarts {
+				reloaded = a.reloadedFiles()
+			}
+			s.proxy.unpause <- reloaded
 
-		case err := <-s.runner.errors:
-			s.cfg.Print("runner: error")
-			s.proxy.setError(err)
+		case ae := <-s.errors:
+			ae.app.cfg.Print("runner: error")
+			s.proxy.metrics.buildFailed(ae.app)
+			ae.app.setError(ae.err)
+		case ar := <-s.restarts:
+			start := time.Now()
+			restarted, err := ar.app.runner.restart(ar.gen)
+			if restarted {
+				s.proxy.metrics.restarted(ar.app, time.Since(start))
+			}
+			if err != nil {
+				s.proxy.metrics.buildFailed(ar.app)
+				ar.app.setError(err)
+			}
 		case err := <-stop:
 			s.Stop()
 			return err
@@ -77,25 +184,98 @@ func (s *Server) start(stop chan error, ready chan error) error {
 	}
 }
 
-func (s *Server) doScan() {
-	modified := s.watcher.scan()
+// forwardErrors sends errors and crash restarts from the app's runner to the
+// server's loop.
+func (s *Server) forwardErrors(a *app) {
+	for {
+		select {
+		case err := <-a.runner.errors:
+			select {
+			case s.errors <- &appError{app: a, err: err}:
+			case <-a.runner.stop:
+				return
+			}
+		case gen := <-a.runner.restarts:
+			select {
+			case s.restarts <- &appRestart{app: a, gen: gen}:
+			case <-a.runner.stop:
+				return
+			}
+		case <-a.runner.stop:
+			return
+		}
+	}
+}
+
+func (s *Server) doScan(ctx context.Context, a *app) {
+	start := time.Now()
+	_, span := s.proxy.tracer.start(ctx, "scan")
+	modified := a.watcher.scan()
+	span.setAttr("tulpa.modified", strconv.FormatBool(modified))
+	span.finish()
+	s.proxy.metrics.scanned(a, time.Since(start))
 	if modified {
-		s.cfg.Print("fs modified, rerunning...")
+		changed := a.watcher.changedFiles()
+		a.cfg.Printf("fs modified (%s), rerunning...", summarizeFiles(changed, changedSummaryMax))
+		a.restarted(changed)
+		a.runner.setChanged(changed)
+		if s.proxy.cache != nil {
+			s.proxy.cache.clear(a)
+		}
 
-		if err := s.runner.run(); err != nil {
-			s.proxy.setError(err)
+		start = time.Now()
+		_, span := s.proxy.tracer.start(ctx, "run")
+		err := a.runner.run()
+		span.setError(err)
+		span.finish()
+		s.proxy.metrics.restarted(a, time.Since(start))
+		go a.watcher.updateGoGraph()
+		if err != nil {
+			s.proxy.metrics.buildFailed(a)
+			a.setError(err)
 			return
 		}
 
-		s.proxy.clearError()
+		a.clearError()
+		if s.cfg.Replay > 0 && s.cfg.Record != "" {
+			go s.replay(a)
+		}
+	}
+
+	a.watcher.ran(time.Now())
+}
+
+// replay resends the app's last recorded requests to it.
+func (s *Server) replay(a *app) {
+	exs := s.proxy.recording.last(a.route.Name)
+	if len(exs) == 0 {
+		return
 	}
 
-	s.watcher.setLastRun(time.Now())
+	newReplayer(a).replay(exs)
+}
+
+// PrintSummary prints each app's request, scan and restart totals.
+func (s *Server) PrintSummary() {
+	s.proxy.metrics.summary(s.apps)
 }
 
 func (s *Server) Stop() {
-	close(s.runner.stop)
-	s.runner.kill()
+	s.proxy.tracer.close()
+	if s.proxy.static != nil {
+		s.proxy.static.close()
+	}
+	for _, a := range s.apps {
+		if !a.managed() {
+			continue
+		}
+		close(a.runner.stop)
+		a.runner.kill()
+		a.watcher.close()
+	}
+	if s.cfg.ProxySocket != "" {
+		ignoreError(os.Remove(s.cfg.ProxySocket))
+	}
 }
 
 func ignoreError(err error) {}
@@ -2,10 +2,14 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -23,6 +27,7 @@ func TestServerGet(t *testing.T) {
 	defer srv.Close()
 
 	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
 	defer checkNoServerError(t, errC)
 
 	res, err := http.Get(fmt.Sprintf("http://%s", s.Addr()))
@@ -56,6 +61,7 @@ func TestServerPost(t *testing.T) {
 	defer srv.Close()
 
 	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
 	defer checkNoServerError(t, errC)
 
 	res, err := http.Post(fmt.Sprintf("http://%s", s.Addr()), "text/plain", strings.NewReader("cool post"))
@@ -69,6 +75,88 @@ func TestServerPost(t *testing.T) {
 	}
 }
 
+func TestServerUnixSocket(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	cfg := newTestConfig()
+	cfg.Upstream = "unix://" + filepath.Join(dir, "app.sock")
+	cfg.ProxySocket = filepath.Join(dir, "proxy.sock")
+
+	s, errC := newTestServer(cfg, "cool")
+	defer checkNoServerError(t, errC)
+
+	// The fake command doesn't listen, so stand in for it once it's started.
+	ln, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", s.Addr().String())
+		},
+	}}
+	res, err := client.Get("http://tulpa/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatal("expected 200, got", res.StatusCode)
+	}
+
+	s.Stop()
+	for _, sock := range []string{"app.sock", "proxy.sock"} {
+		if _, err := os.Stat(filepath.Join(dir, sock)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", sock, err)
+		}
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Initialize()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AppPort == 0 {
+		t.Fatal("expected a free app port to be picked")
+	}
+
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/__tulpa/status", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	st := &status{}
+	if err := json.NewDecoder(res.Body).Decode(st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Apps) != 1 {
+		t.Fatal("expected 1 app, got", len(st.Apps))
+	}
+	if st.Apps[0].AppPort != cfg.AppPort {
+		t.Fatalf("expected app port %d, got %d", cfg.AppPort, st.Apps[0].AppPort)
+	}
+}
+
 func checkNoServerError(t testing.TB, errC chan error) {
 	t.Helper()
 
@@ -101,28 +189,41 @@ func newTestConfigOutErr() (*Config, *bytes.Buffer, *bytes.Buffer) {
 }
 
 func newTestServer(cfg *Config, args ...string) (*Server, chan error) {
-	s := New(cfg, args)
-	errC := s.GoStart()
-
-	hostport := s.Addr().String()
-	port, err := strconv.Atoi(strings.SplitN(hostport, ":", 2)[1])
+	s, err := New(cfg, args)
 	if err != nil {
 		panic(err)
 	}
-	cfg.ProxyPort = port
+	// The fake commands stand in for servers, which keep running.
+	for _, a := range s.apps {
+		if a.managed() {
+			a.runner.env = []string{"_FAKEPROC_SLEEP=1m"}
+		}
+	}
+	errC := s.GoStart()
+
+	if cfg.ProxySocket == "" {
+		cfg.ProxyPort = addrPort(s.Addr().String())
+	}
 	return s, errC
 }
 
 func newTestAppServer(cfg *Config, fn http.HandlerFunc) *httptest.Server {
 	srv := httptest.NewServer(fn)
 
-	hostport := srv.Listener.Addr().String()
-	port, err := strconv.Atoi(strings.SplitN(hostport, ":", 2)[1])
+	cfg.AppPort = addrPort(srv.Listener.Addr().String())
+	return srv
+}
+
+func addrPort(hostport string) int {
+	_, portStr, err := net.SplitHostPort(hostport)
 	if err != nil {
 		panic(err)
 	}
-	cfg.AppPort = port
-	return srv
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		panic(err)
+	}
+	return port
 }
 
 func newTestCase(cfg *Config, fn http.HandlerFunc, args ...string) (*httptest.Server, *Server, chan error) {
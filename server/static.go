@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticPollInterval is how often the static directory is checked for
+// changes when live reload is enabled.
+const staticPollInterval = 500 * time.Millisecond
+
+var errStaticModified = errors.New("static files modified")
+
+// static serves files from a directory, such as a frontend's build output.
+// Requests for files that don't exist go to the app.
+type static struct {
+	cfg    *Config
+	dir    string
+	reload *liveReload
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newStatic(cfg *Config) *static {
+	if cfg.Static == "" {
+		return nil
+	}
+	s := &static{
+		cfg:  cfg,
+		dir:  cfg.Static,
+		stop: make(chan struct{}),
+	}
+	if cfg.LiveReload {
+		s.reload = newLiveReload()
+		go s.poll()
+	}
+	return s
+}
+
+// handler returns a handler responding with the file at the request's path,
+// or index.html for page loads in SPA mode. It returns nil if the request
+// should go to the app instead.
+func (s *static) handler(r *http.Request) http.HandlerFunc {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+
+	name := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			u := *r.URL
+			u.Path += "/"
+			return func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			}
+		}
+		name = filepath.Join(name, "index.html")
+		info, err = os.Stat(name)
+	}
+	if err != nil || info.IsDir() {
+		if !s.cfg.SPA || !isPageLoad(r) {
+			return nil
+		}
+		name = filepath.Join(s.dir, "index.html")
+		if info, err = os.Stat(name); err != nil {
+			return nil
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.serveFile(w, r, name, info)
+	}
+}
+
+func (s *static) serveFile(w http.ResponseWriter, r *http.Request, name string, info os.FileInfo) {
+	if s.reload == nil || filepath.Ext(name) != ".html" {
+		f, err := os.Open(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		return
+	}
+
+	page, err := ioutil.ReadFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(injectLiveReload(page)))
+}
+
+// isPageLoad returns true if the request is a browser navigating to a page,
+// as opposed to loading an asset or calling an api.
+func isPageLoad(r *http.Request) bool {
+	return path.Ext(r.URL.Path) == "" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// poll reloads browsers when files in the static directory change.
+func (s *static) poll() {
+	ticker := time.NewTicker(staticPollInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if s.modifiedSince(last) {
+				s.cfg.Print("static files modified, reloading browsers")
+				s.reload.reload()
+			}
+			last = now
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *static) modifiedSince(t time.Time) bool {
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(t) {
+			s.cfg.Debugf("found modified static file: %v", path)
+			return errStaticModified
+		}
+		return nil
+	})
+	return err == errStaticModified
+}
+
+func (s *static) close() {
+	s.once.Do(func() { close(s.stop) })
+}
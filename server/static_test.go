@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(dir, "index.html"), "<html><body>index</body></html>")
+	writeFile(t, filepath.Join(dir, "app.js"), "console.log('cool')")
+	writeFile(t, filepath.Join(dir, "docs", "index.html"), "docs")
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "api")
+	}))
+	defer api.Close()
+
+	cfg := newTestConfig()
+	cfg.Static = dir
+	cfg.SPA = true
+	cfg.CORS = true
+	// Other routes' requests don't get the default app's static files.
+	cfg.Routes = []*Route{{Host: "api.test", Upstream: api.URL}}
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	tcs := []struct {
+		path   string
+		host   string
+		accept string
+		body   string
+	}{
+		{path: "/app.js", body: "console.log('cool')"},
+		{path: "/", body: "<html><body>index</body></html>"},
+		{path: "/docs", body: "docs"},
+		{path: "/api/users", body: "app"},
+		{path: "/missing.js", accept: "text/html", body: "app"},
+		{path: "/users/1", accept: "text/html,application/xhtml+xml", body: "<html><body>index</body></html>"},
+		{path: "/app.js", host: "api.test", body: "api"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", s.Addr(), tc.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			if tc.host != "" {
+				req.Host = tc.host
+			}
+			req.Header.Set("Origin", "http://example.com")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.Header.Get("Access-Control-Allow-Origin") == "" {
+				t.Fatal("expected CORS headers")
+			}
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.body {
+				t.Fatalf("expected body %q, got %q", tc.body, b)
+			}
+		})
+	}
+
+	w := newWatcher(cfg)
+	if !w.shouldSkipDir(".", dir+"/") {
+		t.Fatal("expected static directory to be skipped by the watcher")
+	}
+
+	// The static directory is skipped however the paths are written.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(cwd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Static = rel
+	w = newWatcher(cfg)
+	if !w.shouldSkipDir(filepath.Dir(dir), dir) {
+		t.Fatal("expected relative static directory to be skipped by the watcher")
+	}
+}
+
+func TestLiveReload(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	indexPath := filepath.Join(dir, "index.html")
+	writeFile(t, indexPath, "<html><body>index</body></html>")
+
+	cfg := newTestConfig()
+	cfg.Static = dir
+	cfg.LiveReload = true
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<html><body>index" + liveReloadScript + "</body></html>"; string(b) != want {
+		t.Fatalf("expected live reload script to be injected, got %q", b)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://%s/__tulpa/livereload", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("expected event stream, got", ct)
+	}
+
+	// Wait for the first poll, so the change isn't missed.
+	time.Sleep(staticPollInterval)
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(indexPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		events <- line
+	}()
+	select {
+	case line := <-events:
+		if strings.TrimSpace(line) != "event: reload" {
+			t.Fatalf("expected reload event, got %q", line)
+		}
+	case <-time.After(3 * staticPollInterval):
+		t.Fatal("timed out waiting for reload event")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
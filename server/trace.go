@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	// traceBatchSize is the most spans sent to the collector at once.
+	traceBatchSize = 256
+	// traceFlushInterval is how often spans are sent to the collector.
+	traceFlushInterval = time.Second
+)
+
+// tracer sends spans for each stage of a request to an OpenTelemetry
+// collector, over OTLP/HTTP with json encoding. A nil tracer, and the nil
+// spans it starts, do nothing, so tracing costs nothing when it's disabled.
+type tracer struct {
+	cfg      *Config
+	endpoint string
+	client   *http.Client
+	spans    chan *span
+	done     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+type spanKey struct{}
+
+// newTracer returns a tracer sending spans to cfg.Trace, or nil if tracing
+// is disabled. The endpoint's path defaults to /v1/traces.
+func newTracer(cfg *Config) (*tracer, error) {
+	if cfg.Trace == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Trace)
+	if err != nil {
+		return nil, fmt.Errorf("trace endpoint: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("trace endpoint %q: expected a url like http://localhost:4318", cfg.Trace)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	t := &tracer{
+		cfg:      cfg,
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 5 * time.Second},
+		spans:    make(chan *span, traceBatchSize*4),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+// start starts a span as a child of the span in ctx, if any.
+func (t *tracer) start(ctx context.Context, name string) (context.Context, *span) {
+	return t.startAt(ctx, name, time.Now())
+}
+
+func (t *tracer) startAt(ctx context.Context, name string, start time.Time) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: spanKindInternal, start: start}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		randomID(s.traceID[:])
+	}
+	randomID(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// withTraceparent returns the request's context with the span from its W3C
+// traceparent header as the parent of new spans.
+func withTraceparent(r *http.Request) context.Context {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return r.Context()
+	}
+	remote := &span{}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return r.Context()
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return r.Context()
+	}
+	return context.WithValue(r.Context(), spanKey{}, remote)
+}
+
+// setTraceparent passes the span in the request's context on to the app.
+func setTraceparent(r *http.Request) {
+	if s := spanFromContext(r.Context()); s != nil && s.tracer != nil {
+		r.Header.Set("traceparent", s.traceparent())
+	}
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+func (s *span) setKind(kind int) {
+	if s != nil {
+		s.kind = kind
+	}
+}
+
+func (s *span) setAttr(k, v string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = v
+}
+
+func (s *span) setError(err error) {
+	if s != nil {
+		s.err = err
+	}
+}
+
+func (s *span) finish() {
+	s.finishAt(time.Now())
+}
+
+func (s *span) finishAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.end = end
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.cfg.Debug("trace: dropping span, collector is behind")
+	}
+}
+
+func (t *tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// close sends the remaining spans to the collector.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.done) })
+	t.wg.Wait()
+}
+
+func (t *tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]map[string]interface{}, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "tulpa"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "tulpa"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		t.cfg.Printf("trace: %v", err)
+		return
+	}
+
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.cfg.Debugf("trace: %v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		t.cfg.Debugf("trace: collector responded %s", res.Status)
+	}
+}
+
+func (s *span) otlp() map[string]interface{} {
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		m["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	return m
+}
+
+func otlpAttributes(attrs map[string]string) []interface{} {
+	l := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		l = append(l, map[string]interface{}{
+			"key":   k,
+			"value": map[string]string{"stringValue": v},
+		})
+	}
+	return l
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
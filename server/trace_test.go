@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string `json:"traceId"`
+				SpanID       string `json:"spanId"`
+				ParentSpanID string `json:"parentSpanId"`
+				Name         string `json:"name"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTrace(t *testing.T) {
+	mockCommand()
+	defer resetCommand()
+
+	var mu sync.Mutex
+	spans := make(map[string]string)
+	parents := make(map[string]string)
+	traces := make(map[string]bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(404)
+			return
+		}
+		req := &otlpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s.SpanID
+					parents[s.Name] = s.ParentSpanID
+					traces[s.TraceID] = true
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	cfg := newTestConfig()
+	cfg.Trace = collector.URL
+	var appTraceparent string
+	app := newTestAppServer(cfg, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		appTraceparent = r.Header.Get("traceparent")
+		mu.Unlock()
+		fmt.Fprint(w, "cool")
+	})
+	defer app.Close()
+	s, errC := newTestServer(cfg, "cool")
+	defer s.Stop()
+	defer checkNoServerError(t, errC)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", s.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	s.proxy.tracer.close()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(traces) != 1 || !traces[traceID] {
+		t.Fatalf("expected spans to continue trace %s, got %v", traceID, traces)
+	}
+	if parents["tulpa.request"] != "b7ad6b7169203331" {
+		t.Fatalf("expected request span to be a child of the incoming span, got parent %q", parents["tulpa.request"])
+	}
+	want := map[string]string{
+		"queue":    "tulpa.request",
+		"debounce": "queue",
+		"scan":     "debounce",
+		"upstream": "tulpa.request",
+	}
+	for name, parent := range want {
+		if parents[name] == "" || parents[name] != spans[parent] {
+			t.Errorf("expected %s span to be a child of %s, got spans %v and parents %v", name, parent, spans, parents)
+		}
+	}
+	if !strings.HasPrefix(appTraceparent, "00-"+traceID+"-"+spans["upstream"]) {
+		t.Fatalf("expected the app to get the upstream span's traceparent, got %q", appTraceparent)
+	}
+}
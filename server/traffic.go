@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// exchange is a request that went through the proxy, and its response.
+type exchange struct {
+	ID         int64         `json:"id"`
+	Start      time.Time     `json:"start"`
+	App        string        `json:"app,omitempty"`
+	RemoteAddr string        `json:"remote_addr"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Host       string        `json:"host"`
+	Proto      string        `json:"proto"`
+	ReqHeader  http.Header   `json:"request_header"`
+	ReqBody    string        `json:"request_body,omitempty"`
+	Status     int           `json:"status"`
+	ResHeader  http.Header   `json:"response_header"`
+	ResBody    string        `json:"response_body,omitempty"`
+	Size       int           `json:"size"`
+	Queue      time.Duration `json:"queue"`
+	Upstream   time.Duration `json:"upstream"`
+	Restarted  bool          `json:"restarted"`
+	// ReqBodyBase64 is the request body if it isn't text, so it can be
+	// replayed.
+	ReqBodyBase64 string `json:"request_body_base64,omitempty"`
+	// Fault is the kind of fault injected into the exchange, if any.
+	Fault string `json:"fault,omitempty"`
+	// Mock is true if the response was served by a mock.
+	Mock bool `json:"mock,omitempty"`
+	// Static is true if the response was a file from the static directory.
+	Static bool `json:"static,omitempty"`
+	// ReqTruncated and ResTruncated are true if the request or response body
+	// was cut off at inspectBodyLimit. Request bodies are kept whole for
+	// replays, and only cut off for the inspector.
+	ReqTruncated bool `json:"request_truncated,omitempty"`
+	ResTruncated bool `json:"response_truncated,omitempty"`
+}
+
+var exchangeID int64
+
+func newExchange(r *http.Request) *exchange {
+	return &exchange{
+		ID:         atomic.AddInt64(&exchangeID, 1),
+		Start:      time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Host:       r.Host,
+		Proto:      r.Proto,
+		ReqHeader:  r.Header.Clone(),
+	}
+}
+
+func (ex *exchange) setRequestBody(body string) {
+	if isTextContent(ex.ReqHeader.Get("Content-Type")) {
+		ex.ReqBody = body
+	} else {
+		ex.ReqBodyBase64 = base64.StdEncoding.EncodeToString([]byte(body))
+	}
+}
+
+// inspected returns a copy of the exchange with the request body cut off at
+// inspectBodyLimit, like the response body.
+func (ex *exchange) inspected() *exchange {
+	if len(ex.ReqBody) <= inspectBodyLimit && len(ex.ReqBodyBase64) <= base64.StdEncoding.EncodedLen(inspectBodyLimit) {
+		return ex
+	}
+	c := *ex
+	if len(c.ReqBody) > inspectBodyLimit {
+		c.ReqBody = c.ReqBody[:inspectBodyLimit]
+	}
+	if n := base64.StdEncoding.EncodedLen(inspectBodyLimit); len(c.ReqBodyBase64) > n {
+		c.ReqBodyBase64 = c.ReqBodyBase64[:n]
+	}
+	c.ReqTruncated = true
+	return &c
+}
+
+// finish fills in the response from the recorder.
+func (ex *exchange) finish(rec *recorder) {
+	ex.Status = rec.status
+	if ex.Status == 0 && !rec.hijacked {
+		ex.Status = http.StatusOK
+	}
+	ex.Size = rec.size
+	ex.ResHeader = rec.Header().Clone()
+	if rec.body != nil && ex.ResHeader.Get("Content-Encoding") == "" && isTextContent(ex.ResHeader.Get("Content-Type")) {
+		ex.ResBody = rec.body.String()
+		ex.ResTruncated = rec.size > rec.body.Len()
+	}
+}
+
+// recorder is the http.ResponseWriter the client's response is written
+// through. It remembers the status and size of the response, and a truncated
+// copy of the body if body is set.
+type recorder struct {
+	http.ResponseWriter
+	status   int
+	size     int
+	body     *bytes.Buffer
+	hijacked bool
+}
+
+func (w *recorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	if w.body != nil {
+		if rest := inspectBodyLimit - w.body.Len(); rest > 0 {
+			if rest > n {
+				rest = n
+			}
+			w.body.Write(b[:rest])
+		}
+	}
+	return n, err
+}
+
+func (w *recorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+// accessLog writes a line for each exchange in the common, combined or json
+// format.
+type accessLog struct {
+	format string
+	w      io.Writer
+	mu     sync.Mutex
+}
+
+func newAccessLog(format string, w io.Writer) (*accessLog, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+		return &accessLog{format: format, w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+}
+
+func (l *accessLog) log(ex *exchange) {
+	var line []byte
+	if l.format == accessLogJSON {
+		b, err := json.Marshal(&accessLogEntry{
+			Time:      ex.Start,
+			App:       ex.App,
+			Remote:    remoteHost(ex.RemoteAddr),
+			Method:    ex.Method,
+			URL:       ex.URL,
+			Proto:     ex.Proto,
+			Status:    ex.Status,
+			Size:      ex.Size,
+			Upstream:  ex.Upstream.Seconds() * 1000,
+			Queue:     ex.Queue.Seconds() * 1000,
+			Restarted: ex.Restarted,
+			Fault:     ex.Fault,
+			Mock:      ex.Mock,
+			Referer:   ex.ReqHeader.Get("Referer"),
+			UserAgent: ex.ReqHeader.Get("User-Agent"),
+		})
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(l.formatLine(ex))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	ignoreError(err)
+}
+
+// formatLine formats the exchange in the common or combined log format,
+// followed by the upstream latency and whether the request restarted the
+// app.
+func (l *accessLog) formatLine(ex *exchange) string {
+	line := fmt.Sprintf("%s - - [%s] %q %d %d",
+		remoteHost(ex.RemoteAddr),
+		ex.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		ex.Method+" "+ex.URL+" "+ex.Proto,
+		ex.Status,
+		ex.Size,
+	)
+	if l.format == accessLogCombined {
+		line += fmt.Sprintf(" %q %q", ex.ReqHeader.Get("Referer"), ex.ReqHeader.Get("User-Agent"))
+	}
+
+	line += fmt.Sprintf(" upstream=%s", ex.Upstream.Round(time.Microsecond))
+	if ex.Restarted {
+		line += " restarted"
+	}
+	if ex.Fault != "" {
+		line += " fault=" + ex.Fault
+	}
+	if ex.Mock {
+		line += " mock"
+	}
+	return line + "\n"
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	App       string    `json:"app,omitempty"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Size      int       `json:"size"`
+	Upstream  float64   `json:"upstream_ms"`
+	Queue     float64   `json:"queue_ms"`
+	Restarted bool      `json:"restarted"`
+	Fault     string    `json:"fault,omitempty"`
+	Mock      bool      `json:"mock,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if addr == "" || addr == "@" {
+		return "-"
+	}
+	return addr
+}
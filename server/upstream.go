@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const unixScheme = "unix"
+
+// upstream is the address the proxy forwards requests to. It is either a
+// regular http url or a unix domain socket, specified as
+// unix:///path/to/sock.
+type upstream struct {
+	url    *url.URL
+	socket string
+}
+
+// parseUpstream parses the upstream address of the named app. An empty string
+// means http://localhost:<port>. A unix socket address without a path
+// ("unix://") is given a path in the temp directory, which tulpa manages. The
+// path includes the app's name, so each app gets its own socket.
+func parseUpstream(s string, port int, name string) (*upstream, error) {
+	if s == "" {
+		s = fmt.Sprintf("http://localhost:%d", port)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != unixScheme {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("upstream %q: unsupported scheme %q", s, u.Scheme)
+		}
+		return &upstream{url: u}, nil
+	}
+
+	sock := u.Host + u.Path
+	if sock == "" {
+		base := fmt.Sprintf("tulpa-%d", os.Getpid())
+		if name != "" {
+			base += "-" + socketName(name)
+		}
+		sock = filepath.Join(os.TempDir(), base+".sock")
+	}
+	return &upstream{
+		url:    &url.URL{Scheme: "http", Host: unixScheme},
+		socket: sock,
+	}, nil
+}
+
+// socketName replaces the characters of a route name that don't belong in a
+// file name.
+func socketName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (u *upstream) String() string {
+	if u.socket != "" {
+		return unixScheme + "://" + u.socket
+	}
+	return u.url.String()
+}
+
+// transport returns the http.RoundTripper used to reach the upstream.
+func (u *upstream) transport() http.RoundTripper {
+	if u.socket == "" {
+		return http.DefaultTransport
+	}
+
+	var d net.Dialer
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, unixScheme, u.socket)
+		},
+	}
+}
+
+// removeSocket removes the socket file of a killed or crashed run, so the
+// application can bind to it again. The socket belongs to tulpa's command, so
+// it's removed even if something is still listening on it.
+func (u *upstream) removeSocket() error {
+	if u.socket == "" {
+		return nil
+	}
+	if err := os.Remove(u.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// port returns the tcp port of the upstream. It's 0 if the upstream is a unix
+// socket or a remote host, since the command doesn't listen on it.
+func (u *upstream) port() int {
+	if u.socket != "" || !isLocalHost(u.url.Hostname()) {
+		return 0
+	}
+	if p := u.url.Port(); p != "" {
+		port, _ := strconv.Atoi(p)
+		return port
+	}
+	if u.url.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+func isLocalHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// freePort asks the kernel for a free tcp port on localhost.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// listen listens on the unix socket at sock if it's set, or on the tcp port
+// otherwise.
+func listen(sock string, port int) (net.Listener, error) {
+	if sock != "" {
+		if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen(unixScheme, sock)
+	}
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", port))
+}
@@ -1,9 +1,10 @@
 package server
 
 import (
-	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,35 +15,280 @@ import (
 type watcher struct {
 	cfg     *Config
 	lastRun time.Time
-	mu      sync.Mutex
+	// changed are the modified files found by the last scan.
+	changed []string
+	// hashes are the contents hashes of files, when changes are detected by
+	// contents instead of mtimes.
+	hashes *hashCache
+	// goGraph limits changes to the files a Go main package is built from.
+	// All files count when it's nil.
+	goGraph *goGraph
+	// cwd resolves relative paths to match goGraph's. realDirs are the
+	// directories of scanned files with their symlinks resolved, for the same
+	// reason.
+	cwd      string
+	realDirs map[string]string
+	// poller finds changes in the background, when polling.
+	poller *poller
+	// pending are the changes taken from the poller since the app last ran,
+	// so they're found again if it fails to.
+	pending []string
+	// static is the absolute path of the static directory, if any.
+	static string
+	mu     sync.Mutex
 }
 
 func newWatcher(cfg *Config) *watcher {
-	return &watcher{
+	w := &watcher{
 		cfg:     cfg,
 		lastRun: time.Now(),
 	}
+	if cfg.Hash {
+		hashes, err := loadHashCache(cfg.HashCache)
+		if err != nil {
+			cfg.Printf("hash cache: %v, starting over", err)
+			hashes, _ = loadHashCache("")
+			hashes.path = cfg.HashCache
+		}
+		w.hashes = hashes
+	}
+	if cfg.Go != "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			cfg.Printf("go: %v", err)
+		}
+		w.cwd = realPath(cwd)
+		w.realDirs = make(map[string]string)
+	}
+	if cfg.Static != "" {
+		w.static = absPath(cfg.Static)
+	}
+	if cfg.Poll > 0 {
+		w.poller = newPoller(w)
+	}
+	return w
+}
+
+// absPath returns the absolute path, or the cleaned path if it can't be
+// made absolute.
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// start starts polling, if enabled.
+func (w *watcher) start() {
+	if w.poller != nil {
+		w.poller.start()
+	}
+}
+
+// close stops polling.
+func (w *watcher) close() {
+	if w.poller != nil {
+		w.poller.close()
+	}
+}
+
+// updateGoGraph reloads the Go package graph, as imports may have changed.
+// The previous graph is kept if it can't be loaded, such as while a file
+// doesn't parse.
+func (w *watcher) updateGoGraph() {
+	if w.cfg.Go == "" {
+		return
+	}
+	start := time.Now()
+	g, err := loadGoGraph(w.cfg)
+	if err != nil {
+		w.cfg.Printf("go: %v", err)
+		return
+	}
+	w.mu.Lock()
+	w.goGraph = g
+	w.mu.Unlock()
+	w.cfg.Debugf("go: %d files in %d packages, loaded in %v", len(g.files), g.packages, time.Since(start))
+}
+
+// triggers returns true if changes to the file can restart the app.
+func (w *watcher) triggers(path string, info os.FileInfo) bool {
+	w.mu.Lock()
+	g := w.goGraph
+	w.mu.Unlock()
+	if g == nil {
+		return true
+	}
+	if info.IsDir() {
+		return false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(w.cwd, path)
+	}
+	return g.includes(filepath.Join(w.realDir(filepath.Dir(path)), filepath.Base(path)))
+}
+
+// realDir returns the directory with its symlinks resolved.
+func (w *watcher) realDir(dir string) string {
+	w.mu.Lock()
+	real, ok := w.realDirs[dir]
+	w.mu.Unlock()
+	if ok {
+		return real
+	}
+	real = realPath(dir)
+	w.mu.Lock()
+	w.realDirs[dir] = real
+	w.mu.Unlock()
+	return real
+}
+
+// prime hashes the watched files, so later scans can tell which ones
+// changed. It does nothing unless changes are detected by contents.
+func (w *watcher) prime() {
+	if w.hashes == nil {
+		return
+	}
+	w.walk()
+	w.commitHashes()
 }
 
 func (w *watcher) scan() bool {
+	var changed []string
+	// The poller has already done the work, so requests don't wait for the
+	// filesystem.
+	if w.poller != nil {
+		taken := w.poller.take()
+		w.mu.Lock()
+		w.pending = uniquePaths(append(w.pending, taken...))
+		changed = append([]string(nil), w.pending...)
+		w.mu.Unlock()
+	} else {
+		changed = w.walk()
+	}
+	w.mu.Lock()
+	w.changed = changed
+	w.mu.Unlock()
+	return len(changed) > 0
+}
+
+// walk returns the files changed since the last run.
+func (w *watcher) walk() []string {
 	w.cfg.Debug("start scan")
 	start := time.Now()
 
-	modified := walk.Walk(".", func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && w.shouldSkipDir(path) {
-			return walk.SkipDir
-		}
+	var mu sync.Mutex
+	var changed []string
+	present := make(map[string]bool)
+	for _, root := range w.roots() {
+		root := root
+		ignoreError(walk.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && w.shouldSkipDir(root, path) {
+				return walk.SkipDir
+			}
+			if w.hashes != nil && !info.IsDir() {
+				mu.Lock()
+				present[path] = true
+				mu.Unlock()
+			}
+
+			if w.triggers(path, info) && w.modified(path, info) {
+				w.cfg.Debugf("found modified file: %v", path)
+				mu.Lock()
+				changed = append(changed, path)
+				mu.Unlock()
+			}
+
+			return nil
+		}))
+	}
 
-		if info.ModTime().After(w.getLastRun()) {
-			w.cfg.Debugf("found modified file: %v", path)
-			return errors.New(path)
+	changed = append(changed, w.scanEnvFiles(present)...)
+	if w.hashes != nil {
+		changed = append(changed, w.hashes.deleted(present)...)
+	}
+	w.cfg.Printf("scan done in %v", time.Since(start))
+	return uniquePaths(changed)
+}
+
+// modified returns true if the file changed since the last run. When hashing,
+// only changes to files' contents count, and directories are ignored.
+func (w *watcher) modified(path string, info os.FileInfo) bool {
+	if w.hashes == nil {
+		return info.ModTime().After(w.getLastRun())
+	}
+	if info.IsDir() || w.hashes.isCacheFile(path, info) {
+		return false
+	}
+	return w.hashes.changed(path, info)
+}
+
+// scanEnvFiles returns the env files modified since the last run, and adds
+// them to present. They're checked even if they aren't in the watched
+// directories, or are ignored.
+func (w *watcher) scanEnvFiles(present map[string]bool) []string {
+	var changed []string
+	for _, path := range w.cfg.EnvFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		present[path] = true
+		if w.modified(path, info) {
+			w.cfg.Debugf("found modified env file: %v", path)
+			changed = append(changed, path)
 		}
+	}
+	return changed
+}
 
+// uniquePaths returns the cleaned paths, sorted and without duplicates.
+func uniquePaths(paths []string) []string {
+	if len(paths) == 0 {
 		return nil
-	})
+	}
+	for i, path := range paths {
+		paths[i] = filepath.Clean(path)
+	}
+	sort.Strings(paths)
+	unique := paths[:1]
+	for _, path := range paths[1:] {
+		if path != unique[len(unique)-1] {
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
 
-	w.cfg.Printf("scan done in %v", time.Since(start))
-	return modified != nil
+// summarizeFiles lists up to max files, and how many more there are.
+func summarizeFiles(files []string, max int) string {
+	if len(files) <= max {
+		return strings.Join(files, ", ")
+	}
+	return fmt.Sprintf("%s, +%d more", strings.Join(files[:max], ", "), len(files)-max)
+}
+
+// changedFiles returns the modified files found by the last scan.
+func (w *watcher) changedFiles() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// roots returns the directories to scan. They default to the command's
+// working directory.
+func (w *watcher) roots() []string {
+	if len(w.cfg.Watch) > 0 {
+		return w.cfg.Watch
+	}
+	if w.cfg.Cwd != "" {
+		return []string{w.cfg.Cwd}
+	}
+	return []string{"."}
 }
 
 func (w *watcher) getLastRun() time.Time {
@@ -57,18 +303,64 @@ func (w *watcher) setLastRun(t time.Time) {
 	w.lastRun = t
 }
 
+// ran records that the app ran successfully at t, with the changes found so
+// far. Until then, scans keep finding them, so a failed run is retried.
+func (w *watcher) ran(t time.Time) {
+	w.mu.Lock()
+	w.lastRun = t
+	w.pending = nil
+	w.mu.Unlock()
+	w.commitHashes()
+}
+
+func (w *watcher) commitHashes() {
+	if w.hashes == nil {
+		return
+	}
+	w.hashes.commit()
+	if err := w.hashes.save(); err != nil {
+		w.cfg.Printf("hash cache: %v", err)
+	}
+}
+
 // Checks to see if this directory should be watched. Don't want to watch
-// hidden directories (like .git) or ignored directories.
-func (w *watcher) shouldSkipDir(path string) bool {
-	if len(path) > 1 && strings.HasPrefix(filepath.Base(path), ".") {
+// hidden directories (like .git), ignored directories, or the static
+// directory, which only triggers live reload. Roots are always watched, even
+// if they're hidden, like "..".
+//
+// Ignored directories are patterns, like node_modules or build/*, matched
+// against the path relative to the root, or the path itself.
+func (w *watcher) shouldSkipDir(root, path string) bool {
+	path = filepath.Clean(path)
+	if path == filepath.Clean(root) {
+		return false
+	}
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return true
+	}
+
+	if w.static != "" && absPath(path) == w.static {
 		return true
 	}
 
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
 	for _, dir := range w.cfg.IgnoreDirs {
-		if dir == path {
+		dir = filepath.Clean(dir)
+		if matchPath(dir, rel) || matchPath(dir, path) {
 			return true
 		}
 	}
 
 	return false
 }
+
+func matchPath(pattern, path string) bool {
+	if pattern == path {
+		return true
+	}
+	ok, err := filepath.Match(pattern, path)
+	return err == nil && ok
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatcherRoots(t *testing.T) {
+	dir, cleanup := getTempdir(t)
+	defer cleanup()
+
+	api := filepath.Join(dir, "services", "api")
+	libs := filepath.Join(dir, "libs")
+	writeFile(t, filepath.Join(api, "main.go"), "package main\n")
+	writeFile(t, filepath.Join(api, "node_modules", "dep.js"), "")
+	writeFile(t, filepath.Join(libs, "lib.go"), "package libs\n")
+	writeFile(t, filepath.Join(libs, "node_modules", "dep.js"), "")
+	writeFile(t, filepath.Join(dir, "unwatched.go"), "package unwatched\n")
+
+	cfg, _, _ := newTestConfigOutErr()
+	cfg.Cwd = api
+	// libs is outside the command's working directory, as ../../libs.
+	cfg.Watch = []string{api, filepath.Join(api, "..", "..", "libs")}
+	cfg.IgnoreDirs = []string{"node_modules"}
+	w := newWatcher(cfg)
+
+	touch := func(path string) {
+		t.Helper()
+		future := w.getLastRun().Add(time.Second)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcs := []struct {
+		path     string
+		modified bool
+	}{
+		{path: filepath.Join(api, "node_modules", "dep.js")},
+		{path: filepath.Join(libs, "node_modules", "dep.js")},
+		{path: filepath.Join(dir, "unwatched.go")},
+		{path: filepath.Join(api, "main.go"), modified: true},
+		{path: filepath.Join(libs, "lib.go"), modified: true},
+	}
+	for _, tc := range tcs {
+		// Directories are modified when files are written to them.
+		w.setLastRun(time.Now().Add(time.Second))
+		touch(tc.path)
+		if modified := w.scan(); modified != tc.modified {
+			t.Errorf("%s: expected modified %v, got %v", tc.path, tc.modified, modified)
+		}
+		w.setLastRun(time.Now().Add(time.Hour))
+	}
+}
+
+func TestShouldSkipDir(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.IgnoreDirs = []string{"node_modules", "build/*"}
+	w := newWatcher(cfg)
+
+	tcs := []struct {
+		root string
+		path string
+		skip bool
+	}{
+		{root: ".", path: "."},
+		{root: "..", path: ".."},
+		{root: "../libs", path: "../libs"},
+		{root: "..", path: "../.git", skip: true},
+		{root: ".", path: "node_modules", skip: true},
+		{root: "../libs", path: "../libs/node_modules", skip: true},
+		{root: "../libs", path: "../libs/src/node_modules"},
+		{root: ".", path: "build/out", skip: true},
+		{root: ".", path: "build"},
+	}
+	for _, tc := range tcs {
+		if skip := w.shouldSkipDir(tc.root, tc.path); skip != tc.skip {
+			t.Errorf("%s in %s: expected skip %v, got %v", tc.path, tc.root, tc.skip, skip)
+		}
+	}
+}
+
+func TestSummarizeFiles(t *testing.T) {
+	files := uniquePaths([]string{"./c.go", "a.go", "b.go", "a.go", "d/../d.go"})
+	if want := []string{"a.go", "b.go", "c.go", "d.go"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("expected %v, got %v", want, files)
+	}
+	if got := summarizeFiles(files, 4); got != "a.go, b.go, c.go, d.go" {
+		t.Fatal("unexpected summary", got)
+	}
+	if got := summarizeFiles(files, 2); got != "a.go, b.go, +2 more" {
+		t.Fatal("unexpected summary", got)
+	}
+}